@@ -0,0 +1,154 @@
+package webot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventBackfillData /sys/backfill/start 和 /sys/backfill/end 事件
+//
+// 重新登录以后会从上一次确认的同步点补收断线期间的消息，这些消息的 IsBackfill 为 true
+type EventBackfillData struct {
+	Since time.Time // 断线前最后一条消息的时间
+	Count int       // 补收的消息数目，只有 end 事件才有
+	Err   error
+}
+
+// syncPoint 上一次确认的同步点，和登录信息一起保存在 baseInfo 缓存中
+type syncPoint struct {
+	SyncKey     *SyncKey `json:"syncKey"`
+	LastMsgTime int64    `json:"lastMsgTime"`
+	LastMsgID   string   `json:"lastMsgId"`
+	BaseRequest struct {
+		Uin int64
+	} `json:"baseRequest"`
+}
+
+func (wechat *WeChat) cachedSyncPoint() *syncPoint {
+
+	data, err := ioutil.ReadFile(wechat.conf.baseInfoCachePath())
+	if err != nil {
+		return nil
+	}
+
+	point := new(syncPoint)
+	if err = json.Unmarshal(data, point); err != nil || point.SyncKey.IsEmpty() {
+		return nil
+	}
+
+	return point
+}
+
+// resumeSyncPoint 登录成功以后从同一个账号上一次的同步点继续同步
+func (wechat *WeChat) resumeSyncPoint(point *syncPoint) {
+
+	wechat.backfill = nil
+
+	if point == nil || point.BaseRequest.Uin != wechat.BaseRequest.Wxuin {
+		return
+	}
+
+	wechat.log.Infof(`从同步点 [%s] 继续同步 ...`, point.SyncKey)
+
+	wechat.syncKey = point.SyncKey
+	wechat.lastMsg.mark(point.LastMsgTime, point.LastMsgID)
+	wechat.backfill = point
+}
+
+// msgMark 最后一条处理过的消息
+type msgMark struct {
+	sync.Mutex
+	time int64
+	id   string
+}
+
+// mark 记录比当前更新的消息
+func (mm *msgMark) mark(createTime int64, id string) {
+	mm.Lock()
+	defer mm.Unlock()
+	if msgAfter(createTime, id, mm.time, mm.id) {
+		mm.time, mm.id = createTime, id
+	}
+}
+
+func (mm *msgMark) get() (int64, string) {
+	mm.Lock()
+	defer mm.Unlock()
+	return mm.time, mm.id
+}
+
+// msgAfter 消息 (createTime, id) 是否在 (lastTime, lastID) 之后，同一秒内的消息按 MsgId 比较
+func msgAfter(createTime int64, id string, lastTime int64, lastID string) bool {
+	if createTime != lastTime {
+		return createTime > lastTime
+	}
+	if id == lastID {
+		return false
+	}
+	n, e1 := strconv.ParseUint(id, 10, 64)
+	last, e2 := strconv.ParseUint(lastID, 10, 64)
+	if e1 != nil || e2 != nil {
+		return true
+	}
+	return n > last
+}
+
+// runBackfill 补收断线期间的消息，失败时通过 retry 退避重试
+//
+// retry 放弃以后保留同步点，重新登录以后继续补收，避免剩下的消息被当作普通消息
+func (wechat *WeChat) runBackfill(retry func(error) error) error {
+
+	point := wechat.backfill
+
+	since := time.Unix(point.LastMsgTime, 0)
+	wechat.log.Infof(`开始补收 %v 以后的消息 ...`, since)
+
+	wechat.queueBackfill(`/sys/backfill/start`, EventBackfillData{Since: since})
+
+	total := 0
+	for {
+		count, err := wechat.syncMessages(point)
+		total += count
+		if err == nil {
+			break
+		}
+		wechat.log.Errorf(`补收消息失败: %v`, err)
+		if err = retry(err); err != nil {
+			wechat.queueBackfill(`/sys/backfill/end`, EventBackfillData{Since: since, Count: total, Err: err})
+			return err
+		}
+	}
+
+	wechat.backfill = nil
+
+	wechat.log.Infof(`补收消息结束，共 %d 条 ...`, total)
+	wechat.queueBackfill(`/sys/backfill/end`, EventBackfillData{Since: since, Count: total})
+
+	return nil
+}
+
+// queueBackfill start 和 end 事件同样经过 backfillQueue，保证在补收的消息之前和之后
+func (wechat *WeChat) queueBackfill(path string, data EventBackfillData) {
+	wechat.backfillEvt <- Event{
+		Type: `Backfill`,
+		From: `Server`,
+		Path: path,
+		To:   `End`,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+}
+
+// backfillQueue 依次完成补收消息的语音识别和附件下载，然后进入 serverEvt
+func (wechat *WeChat) backfillQueue() {
+	for evt := range wechat.backfillEvt {
+		if data, ok := evt.Data.(EventMsgData); ok {
+			wechat.prepareMsg(&data)
+			evt.Data = data
+		}
+		wechat.evtStream.serverEvt <- evt
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"sync"
@@ -42,6 +41,8 @@ type Contact struct {
 	Alias           string
 	EncryChatRoomID string `json:"EncryChatRoomId"`
 	Type            int
+	IsOwner         int    // 群组: 1 表示自己是群主
+	ChatRoomOwner   string // 群组: 群主的 UserName
 	MemberList      []*Contact
 }
 
@@ -118,9 +119,9 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 
 	count := len(cts)
 
-	log.Debugf(`一共需要处理 [%d] 个联系人`, count)
+	wechat.log.Debugf(`一共需要处理 [%d] 个联系人`, count)
 	if count > 300 {
-		log.Warn(`您的联系人较多，可能需要等待1分钟左右`) // TODO 用多线程比较
+		wechat.log.Warn(`您的联系人较多，可能需要等待1分钟左右`) // TODO 用多线程比较
 	}
 	// 有以下几种情况需要处理
 	// 1. 内存和文件系统中都不存在联系人 ==> 直接新的cts数据初始化内存然后写文件
@@ -128,7 +129,7 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 	// 3. 内存和文件系统中都有联系人 ==> 以内存中的数据为主，更新数据，然后写文件
 	//
 	c := wechat.cache
-	log.Debug(`准备开始处理联系人信息`)
+	wechat.log.Debug(`准备开始处理联系人信息`)
 	c.userGG = make(map[string]string)
 
 	if len(c.ggmap) == 0 {
@@ -140,11 +141,12 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 	}
 
 	if len(c.ggmap) == 0 { // 第一次启动最简单，直接刷进去
-		log.Debug(`联系人没有本地缓存，为每一个用户生成唯一ID`)
+		wechat.log.Debug(`联系人没有本地缓存，为每一个用户生成唯一ID`)
 		for _, v := range cts {
 			var nc *Contact
 			bs, _ := json.Marshal(v)
 			json.NewDecoder(bytes.NewReader(bs)).Decode(&nc)
+			nc.normalize()
 
 			nc.GGID = uuid.NewV4().String()
 			nc.HeadHash = contactHeadImgHash(wechat, nc) // 这里可能会比较耗时，但是是必须的
@@ -152,7 +154,7 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 			c.updateContact(nc)
 		}
 	} else {
-		log.Debug(`发现联系人本地缓存，执行diff逻辑`)
+		wechat.log.Debug(`发现联系人本地缓存，执行diff逻辑`)
 
 		tempNickGG := c.nickGG
 
@@ -166,14 +168,14 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 			ggids := tempNickGG[nc.NickName]
 
 			if len(ggids) == 0 { // 由于改名，找不到这个人待处理
-				log.Warnf(`新添加或者离线时修改过昵称的联系人 [%s]`, nc.NickName)
+				wechat.log.Warnf(`新添加或者离线时修改过昵称的联系人 [%s]`, nc.NickName)
 				badguys = append(badguys, v)
 			} else if len(ggids) == 1 { // 找到了1个id，对比其他信息
 				oc := c.ggmap[ggids[0]]
 				nc.GGID = oc.GGID
 				nc.HeadHash = contactHeadImgHash(wechat, nc)
 				if nc.HeadHash != oc.HeadHash {
-					log.Warnf(`我们认为[%s]修改了他的头像，但是也有可能是有2个人同时修改了昵称，请仔细检查,如若有误,请手动更改cache文件中的mapping 关系 GGID: %s`, nc.NickName, nc.GGID)
+					wechat.log.Warnf(`我们认为[%s]修改了他的头像，但是也有可能是有2个人同时修改了昵称，请仔细检查,如若有误,请手动更改cache文件中的mapping 关系 GGID: %s`, nc.NickName, nc.GGID)
 				}
 				c.updateContact(nc)
 				delete(tempNickGG, nc.NickName)
@@ -183,7 +185,7 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 					oc := c.ggmap[id]
 					// 这里认为找到唯一id的名字了
 					if oc.HeadHash == contactHeadImgHash(wechat, nc) {
-						log.Infof(`已经处理同名联系人: %s`, nc.NickName)
+						wechat.log.Infof(`已经处理同名联系人: %s`, nc.NickName)
 						nc.GGID = oc.GGID
 						nc.HeadHash = oc.HeadHash
 						c.updateContact(nc)
@@ -227,14 +229,14 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 				ggids := tempNickGG[needRemoveNick]
 				oc := c.ggmap[ggids[i]]
 
-				log.Warnf(`我们认为[%s]将昵称改为[%s] GGID:%s`, oc.NickName, nc.NickName, oc.GGID)
+				wechat.log.Warnf(`我们认为[%s]将昵称改为[%s] GGID:%s`, oc.NickName, nc.NickName, oc.GGID)
 
 				nc.GGID = oc.GGID
 				nc.HeadHash = oc.HeadHash
 
 				tempNickGG[oc.NickName] = append(ggids[:i], ggids[i+1:]...)
 			} else {
-				log.Warnf(`无法确认用户id 作为新用户处理 nickName: [%s]`, nc.NickName)
+				wechat.log.Warnf(`无法确认用户id 作为新用户处理 nickName: [%s]`, nc.NickName)
 
 				nc.GGID = uuid.NewV4().String()
 				nc.HeadHash = contactHeadImgHash(wechat, nc)
@@ -252,9 +254,9 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 			}
 		}
 		if len(lostUser) != 0 {
-			log.Warn(`丢失了以下用户 so sorry ~ ~`)
+			wechat.log.Warn(`丢失了以下用户 so sorry ~ ~`)
 			for nick, _ := range lostUser {
-				log.Warnf(`用户名: %s ...`, nick)
+				wechat.log.Warnf(`用户名: %s ...`, nick)
 			}
 		}
 	}
@@ -290,15 +292,15 @@ func (wechat *WeChat) appendContacts(cts []map[string]interface{}) {
 			nc.GGID = oc.GGID
 			nc.HeadHash = oc.HeadHash
 			c.updateContact(nc)
-			log.Infof(`更新联系人 [%s] ...`, nc.NickName)
+			wechat.log.Infof(`更新联系人 [%s] ...`, nc.NickName)
 		} else {
 			// 新建
 			nc.GGID = uuid.NewV4().String()
 			nc.HeadHash = contactHeadImgHash(wechat, nc)
 			c.updateContact(nc)
-			log.Infof(`创建新的联系人 [%s] ...`, nc.NickName)
+			wechat.log.Infof(`创建新的联系人 [%s] ...`, nc.NickName)
 		}
-		//log.Debug(nc)
+		//wechat.log.Debug(nc)
 	}
 
 	if wechat.conf.UniqueGroupMember {
@@ -325,21 +327,21 @@ func (c *cache) contactByGGID(ggid string) (*Contact, error) {
 	if contact, found := c.ggmap[ggid]; found {
 		return contact, nil
 	}
-	return nil, errors.New(`Not Found`)
+	return nil, ErrContactNotFound
 }
 
 func (c *cache) ggidsByNickName(nn string) ([]string, error) {
 	if ggids, found := c.nickGG[nn]; found {
 		return ggids, nil
 	}
-	return nil, errors.New(`Not Found`)
+	return nil, ErrContactNotFound
 }
 
 func (c *cache) contactByUserName(un string) (*Contact, error) {
 	if ggid, found := c.userGG[un]; found {
 		return c.contactByGGID(ggid)
 	}
-	return nil, errors.New(`Not Found`)
+	return nil, ErrContactNotFound
 }
 
 func (c *cache) writeToFile() error {
@@ -359,6 +361,19 @@ func (c *cache) load() (m1 map[string]*Contact, m2 map[string][]string) {
 	_ = unmarshalLocalFile(c.rootPath+`1.json`, &m1)
 	_ = unmarshalLocalFile(c.rootPath+`2.json`, &m2)
 
+	// 旧版本的缓存中昵称没有规范化，这里统一处理一次保证和服务器数据一致
+	for _, contact := range m1 {
+		contact.normalize()
+	}
+	if m2 != nil {
+		nickGG := make(map[string][]string, len(m2))
+		for nick, ggids := range m2 {
+			nn := normalizeContent(nick)
+			nickGG[nn] = append(nickGG[nn], ggids...)
+		}
+		m2 = nickGG
+	}
+
 	return m1, m2
 }
 
@@ -378,7 +393,7 @@ func contactHeadImgHash(wechat *WeChat, contact *Contact) string {
 
 	data, err := wechat.GetContactHeadImg(contact)
 	if err != nil {
-		log.Errorf(`获取 [%s] 头像失败...`, contact.NickName)
+		wechat.log.Errorf(`获取 [%s] 头像失败...`, contact.NickName)
 		return ``
 	}
 
@@ -396,5 +411,8 @@ func newContact(m map[string]interface{}) (*Contact, error) {
 	}
 	var c *Contact
 	err = json.Unmarshal(data, &c)
+	if c != nil {
+		c.normalize()
+	}
 	return c, err
 }
@@ -3,7 +3,6 @@ package webot
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/url"
@@ -175,20 +174,18 @@ func (wechat *WeChat) fetchGroups(usernames []string) ([]map[string]interface{},
 	url := fmt.Sprintf(`%s/webwxbatchgetcontact?type=ex&r=%v`, wechat.BaseURL, time.Now().Unix()*1000)
 	resp := new(batchGetContactResponse)
 
-	wechat.Excute(url, bytes.NewReader(data), resp)
-
-	if resp.IsSuccess() {
-		return resp.ContactList, nil
+	if err = wechat.Excute(url, bytes.NewReader(data), resp); err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New(`fetchGroups error`)
+	return resp.ContactList, nil
 }
 
 func (wechat *WeChat) fetchGroupsMembers(groups []map[string]interface{}) ([]map[string]interface{}, error) {
 
 	list := make([]map[string]string, 0)
 
-	//log.Debugf(`微信群组 %s`, groups)
+	//wechat.log.Debugf(`微信群组 %s`, groups)
 	for _, group := range groups {
 
 		encryChatRoomID, _ := group[`EncryChatRoomId`].(string)
@@ -204,7 +201,7 @@ func (wechat *WeChat) fetchGroupsMembers(groups []map[string]interface{}) ([]map
 		}
 	}
 
-	log.Debug(`群组成员加载中，请稍后...`)
+	wechat.log.Debug(`群组成员加载中，请稍后...`)
 	return wechat.fetchMembers(list), nil
 }
 
@@ -227,7 +224,7 @@ func (wechat *WeChat) fetchMembers(list []map[string]string) []map[string]interf
 
 	if !resp.IsSuccess() {
 		err := fmt.Errorf(`list: %s`, list)
-		log.Errorf(`获取群组成员失败 %s ...`, err)
+		wechat.log.Errorf(`获取群组成员失败 %s ...`, err)
 	}
 
 	return resp.ContactList
@@ -244,11 +241,11 @@ func (wechat *WeChat) UpateGroupIfNeeded(groupID string) {
 // ForceUpdateGroup upate group infomation
 func (wechat *WeChat) ForceUpdateGroup(groupUserName string) {
 
-	log.Debugf(`准备强制更新群组用户名: [%s] ...`, groupUserName)
+	wechat.log.Debugf(`准备强制更新群组用户名: [%s] ...`, groupUserName)
 
 	groups, err := wechat.fetchGroups([]string{groupUserName})
 	if err != nil || len(groups) != 1 {
-		log.Error(`同步群组列表失败...`)
+		wechat.log.Error(`同步群组列表失败...`)
 		return
 	}
 
@@ -261,7 +258,7 @@ func (wechat *WeChat) ForceUpdateGroup(groupUserName string) {
 
 	memberList, err := wechat.fetchGroupsMembers(groups)
 	if err != nil {
-		log.Error(`同步群组成员失败...`)
+		wechat.log.Error(`同步群组成员失败...`)
 		return
 	}
 
@@ -281,7 +278,7 @@ func (wechat *WeChat) ContactByUserName(un string) (*Contact, error) {
 
 	ggid, found := wechat.cache.userGG[un]
 	if !found {
-		return nil, errors.New(`not found`)
+		return nil, ErrContactNotFound
 	}
 
 	return wechat.cache.contactByGGID(ggid)
@@ -307,7 +304,7 @@ func (wechat *WeChat) UserNameByNickName(nn string) ([]string, error) {
 func (wechat *WeChat) ContactsByNickName(nn string) ([]*Contact, error) {
 	ggids, found := wechat.cache.nickGG[nn]
 	if !found {
-		return nil, errors.New(`not found`)
+		return nil, ErrContactNotFound
 	}
 	var cs []*Contact
 	for _, ggid := range ggids {
@@ -319,7 +316,7 @@ func (wechat *WeChat) ContactsByNickName(nn string) ([]*Contact, error) {
 	if len(cs) > 0 {
 		return cs, nil
 	}
-	return nil, errors.New(`not found`)
+	return nil, ErrContactNotFound
 }
 
 // ContactByGGID ...
@@ -327,7 +324,7 @@ func (wechat *WeChat) ContactByGGID(id string) (*Contact, error) {
 	if c, found := wechat.cache.ggmap[id]; found {
 		return c, nil
 	}
-	return nil, errors.New(`not found`)
+	return nil, ErrContactNotFound
 }
 
 // AllContacts ...
@@ -364,14 +361,14 @@ func (wechat *WeChat) modifyRemarkName(un string) (string, error) {
 	wechat.Excute(url, bytes.NewReader(data), resp)
 
 	if !resp.IsSuccess() {
-		log.Error(resp.Error())
+		wechat.log.Error(resp.Error())
 	}
 
 	return `Test`, nil
 }
 
 func (wechat *WeChat) contactDidChange(cts []map[string]interface{}, changeType int) {
-	log.Info(`检测到联系人发生了改变，准备更新本地联系人...`)
+	wechat.log.Info(`检测到联系人发生了改变，准备更新本地联系人...`)
 	if changeType == Modify { // 修改
 		var mcts []map[string]interface{}
 		for _, v := range cts {
@@ -397,7 +394,7 @@ func (wechat *WeChat) contactDidChange(cts []map[string]interface{}, changeType
 }
 
 func (wechat *WeChat) groupMemberDidChange(groups []map[string]interface{}) {
-	log.Info(`检测到群成员发生了改变，准备更新群组列表...`)
+	wechat.log.Info(`检测到群成员发生了改变，准备更新群组列表...`)
 	for _, group := range groups {
 		wechat.ForceUpdateGroup(group[`UserName`].(string))
 	}
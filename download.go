@@ -0,0 +1,326 @@
+package webot
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/h2non/filetype.v1"
+)
+
+// MediaKind 附件类型，同时也是本地存储的目录名
+type MediaKind string
+
+const (
+	// MediaImage 图片和表情
+	MediaImage MediaKind = `image`
+	// MediaVoice 语音
+	MediaVoice MediaKind = `voice`
+	// MediaVideo 视频和小视频
+	MediaVideo MediaKind = `video`
+	// MediaFile 文件 (MsgType 49)
+	MediaFile MediaKind = `file`
+)
+
+// MediaSink 自定义附件的保存位置，例如对象存储
+//
+// 附件直接写入 MediaSink，不会断点续传也不会按 sha1 去重
+type MediaSink interface {
+	// Save 保存 r 中的内容，返回保存后的位置
+	Save(kind MediaKind, name string, r io.Reader) (string, error)
+}
+
+// mediaStore 本地附件存储，按内容 sha1 去重
+type mediaStore struct {
+	sync.Mutex
+	root   string
+	hashes map[string]string // sha1 => path
+	log    *botLogger
+}
+
+func newMediaStore(root string, l *botLogger) *mediaStore {
+	ms := &mediaStore{
+		log:    l,
+		root:   root,
+		hashes: make(map[string]string),
+	}
+	_ = unmarshalLocalFile(ms.indexPath(), &ms.hashes)
+	return ms
+}
+
+func (ms *mediaStore) indexPath() string {
+	return filepath.Join(ms.root, `media-hash.json`)
+}
+
+func (ms *mediaStore) dir(kind MediaKind) (string, error) {
+	dir := filepath.Join(ms.root, string(kind))
+	return dir, os.MkdirAll(dir, os.ModePerm)
+}
+
+// commit 下载完成的文件入库，内容相同的文件只保留一份
+func (ms *mediaStore) commit(partPath, finalPath, sum string) (string, error) {
+
+	ms.Lock()
+	defer ms.Unlock()
+
+	if exist, found := ms.hashes[sum]; found {
+		if _, err := os.Stat(exist); err == nil {
+			os.Remove(partPath)
+			return exist, nil
+		}
+	}
+
+	if err := os.Rename(partPath, finalPath); err != nil {
+		return ``, err
+	}
+
+	ms.hashes[sum] = finalPath
+	data, _ := json.Marshal(ms.hashes)
+	if err := createFile(ms.indexPath(), data, false); err != nil {
+		ms.log.Errorf(`保存附件索引失败: %v`, err)
+	}
+
+	return finalPath, nil
+}
+
+// isAttachment 文件消息 MsgType 为 49, AppMsgType 为 6
+func isAttachment(m map[string]interface{}) bool {
+	msgType, _ := m[`MsgType`].(float64)
+	appMsgType, _ := m[`AppMsgType`].(float64)
+	mediaID, _ := m[`MediaId`].(string)
+	return msgType == 49 && appMsgType == 6 && len(mediaID) > 0
+}
+
+func (wechat *WeChat) attachmentURL(sender, mediaID, fileName string) string {
+
+	host := ``
+	if u, err := url.Parse(wechat.BaseURL); err == nil {
+		host = u.Host
+	}
+
+	params := url.Values{}
+	params.Set(`sender`, sender)
+	params.Set(`mediaid`, mediaID)
+	params.Set(`filename`, fileName)
+	params.Set(`fromuser`, str(wechat.BaseRequest.Wxuin))
+	params.Set(`pass_ticket`, wechat.BaseRequest.PassTicket)
+	params.Set(`webwx_data_ticket`, wechat.CookieDataTicket())
+
+	return fmt.Sprintf(`https://file.%s/cgi-bin/mmwebwx-bin/webwxgetmedia?%s`, host, params.Encode())
+}
+
+// DownloadAttachment 下载文件消息中的文件并写入 w
+func (wechat *WeChat) DownloadAttachment(msg EventMsgData, w io.Writer) (int64, error) {
+	if len(msg.MediaID) == 0 {
+		return 0, fmt.Errorf(`msg [%s] is not a file msg`, msg.MsgID)
+	}
+	// 文件的下载地址里带有 webwx_data_ticket，重新生成一次以免 cookie 已经刷新
+	return wechat.DownloadTo(wechat.attachmentURL(msg.FromUserName, msg.MediaID, msg.FileName), w)
+}
+
+func mediaKindOf(msgType int64) MediaKind {
+	switch msgType {
+	case 34:
+		return MediaVoice
+	case 43, 62:
+		return MediaVideo
+	case 49:
+		return MediaFile
+	}
+	return MediaImage
+}
+
+func mediaKindOfURL(mediaURL string) MediaKind {
+	switch {
+	case strings.Contains(mediaURL, `webwxgetvoice`):
+		return MediaVoice
+	case strings.Contains(mediaURL, `webwxgetvideo`):
+		return MediaVideo
+	case strings.Contains(mediaURL, `webwxgetmedia`):
+		return MediaFile
+	}
+	return MediaImage
+}
+
+func (wechat *WeChat) mediaRequest(mediaURL string, offset int64) (*http.Response, error) {
+
+	req, err := http.NewRequest(`GET`, mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(`Range`, fmt.Sprintf(`bytes=%d-`, offset)) // 小视频必须带这个 header
+
+	resp, err := wechat.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 断点续传时 .part 已经完整，服务器会返回 416，由调用者处理
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 {
+		return resp, nil
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf(`download media failed: %s`, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// DownloadTo 下载附件并写入 w, 返回写入的字节数
+func (wechat *WeChat) DownloadTo(mediaURL string, w io.Writer) (int64, error) {
+
+	resp, err := wechat.mediaRequest(mediaURL, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return io.Copy(w, resp.Body)
+}
+
+// DownloadMedia use to download a voice or immage msg
+func (wechat *WeChat) DownloadMedia(url string, localPath string) (string, error) {
+	return wechat.downloadToStorage(url, mediaKindOfURL(url), localPath)
+}
+
+// DownloadMsgMedia 下载消息中的附件，配置了 MediaSink 时保存到 MediaSink
+func (wechat *WeChat) DownloadMsgMedia(msg EventMsgData) (string, error) {
+
+	if !msg.IsMediaMsg || len(msg.MediaURL) == 0 {
+		return ``, fmt.Errorf(`msg [%s] has no media`, msg.MsgID)
+	}
+
+	kind := mediaKindOf(msg.MsgType)
+
+	name := msg.MsgID
+	if len(msg.FileName) > 0 {
+		name += `-` + filepath.Base(msg.FileName)
+	}
+
+	if sink := wechat.conf.MediaSink; sink != nil {
+		resp, err := wechat.mediaRequest(msg.MediaURL, 0)
+		if err != nil {
+			return ``, err
+		}
+		defer resp.Body.Close()
+		return sink.Save(kind, name, resp.Body)
+	}
+
+	return wechat.downloadToStorage(msg.MediaURL, kind, name)
+}
+
+// downloadToStorage 下载到 Storage/kind/ 目录，支持断点续传
+func (wechat *WeChat) downloadToStorage(mediaURL string, kind MediaKind, name string) (string, error) {
+
+	ms := wechat.media
+
+	dir, err := ms.dir(kind)
+	if err != nil {
+		return ``, err
+	}
+
+	partPath := filepath.Join(dir, name+`.part`)
+
+	offset := int64(0)
+	if info, e := os.Stat(partPath); e == nil {
+		offset = info.Size()
+	}
+
+	resp, err := wechat.mediaRequest(mediaURL, offset)
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
+
+	hs := sha1.New()
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// Content-Range: bytes */size 和已经下载的大小一致时直接入库，否则重新下载
+		var size int64
+		if _, e := fmt.Sscanf(resp.Header.Get(`Content-Range`), `bytes */%d`, &size); e != nil || size != offset {
+			wechat.log.Warnf(`[%s] 无法继续下载，重新下载 ...`, name)
+			if err = os.Remove(partPath); err != nil {
+				return ``, err
+			}
+			return wechat.downloadToStorage(mediaURL, kind, name)
+		}
+		if err = hashFile(hs, partPath); err != nil {
+			return ``, err
+		}
+		return ms.commitPart(partPath, dir, name, hs)
+	}
+
+	oflag := os.O_CREATE | os.O_WRONLY
+
+	if resp.StatusCode == http.StatusPartialContent && offset > 0 {
+		wechat.log.Debugf(`继续下载 [%s]，已下载 %d 字节 ...`, name, offset)
+		if err = hashFile(hs, partPath); err != nil {
+			return ``, err
+		}
+		oflag |= os.O_APPEND
+	} else {
+		oflag |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(partPath, oflag, 0666)
+	if err != nil {
+		return ``, err
+	}
+
+	_, err = io.Copy(io.MultiWriter(file, hs), resp.Body)
+	file.Close()
+	if err != nil {
+		return ``, err
+	}
+
+	return ms.commitPart(partPath, dir, name, hs)
+}
+
+// commitPart 根据内容补上扩展名然后入库
+func (ms *mediaStore) commitPart(partPath, dir, name string, hs hash.Hash) (string, error) {
+
+	ext := ``
+	if head, e := readHead(partPath); e == nil && len(filepath.Ext(name)) == 0 {
+		if t, e := filetype.Match(head); e == nil && len(t.Extension) > 0 && t.Extension != `unknown` {
+			ext = `.` + t.Extension
+		}
+	}
+
+	return ms.commit(partPath, filepath.Join(dir, name+ext), fmt.Sprintf(`%x`, hs.Sum(nil)))
+}
+
+func hashFile(hs hash.Hash, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(hs, file)
+	return err
+}
+
+func readHead(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 261)
+	n, err := io.ReadFull(file, head)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return head[:n], err
+}
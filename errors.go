@@ -0,0 +1,85 @@
+package webot
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrSessionExpired 登录态失效，需要重新登录
+	ErrSessionExpired = errors.New(`webot: session expired`)
+	// ErrRateLimited 请求过于频繁
+	ErrRateLimited = errors.New(`webot: rate limited`)
+	// ErrNotLoggedIn 还没有登录
+	ErrNotLoggedIn = errors.New(`webot: not logged in`)
+	// ErrContactNotFound 本地缓存中找不到联系人
+	ErrContactNotFound = errors.New(`webot: contact not found`)
+	// ErrQRCodeExpired 二维码多次过期，没有人扫码
+	ErrQRCodeExpired = errors.New(`webot: qrcode expired`)
+)
+
+type retCode struct {
+	desc      string
+	err       error
+	retryable bool
+}
+
+// 已知的 BaseResponse.Ret 和 synccheck retcode
+var retCodes = map[int]retCode{
+	-1:   {`系统错误`, nil, true},
+	1:    {`参数错误`, nil, false},
+	1100: {`已在手机上退出网页版微信`, ErrSessionExpired, false},
+	1101: {`已在其他地方登录网页版微信`, ErrSessionExpired, false},
+	1102: {`cookie 失效`, ErrSessionExpired, false},
+	1203: {`当前账号不能登录网页版微信`, nil, false},
+	1205: {`操作太频繁`, ErrRateLimited, true},
+}
+
+// APIError 微信接口返回的错误
+type APIError struct {
+	Ret      int
+	ErrMsg   string
+	Endpoint string
+}
+
+func (e *APIError) Error() string {
+	msg := e.ErrMsg
+	if len(msg) == 0 {
+		msg = retCodes[e.Ret].desc
+	}
+	return fmt.Sprintf(`webot: %s ret=%d msg=[%s]`, e.Endpoint, e.Ret, msg)
+}
+
+// Is 支持 errors.Is(err, ErrSessionExpired) 等判断
+func (e *APIError) Is(target error) bool {
+	rc, found := retCodes[e.Ret]
+	return found && rc.err != nil && rc.err == target
+}
+
+// Retryable 稍后重试是否有可能成功
+func (e *APIError) Retryable() bool {
+	return retCodes[e.Ret].retryable
+}
+
+// IsRetryable 判断 err 是否是临时性的错误
+//
+// 网络错误只有超时才算，证书错误和 DNS 解析失败等重试也没有用
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// endpoint 接口名称，例如 webwxsync
+func endpoint(u *url.URL) string {
+	return u.Path[strings.LastIndex(u.Path, `/`)+1:]
+}
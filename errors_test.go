@@ -0,0 +1,38 @@
+package webot
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{`system error`, &APIError{Ret: -1}, true},
+		{`rate limited`, &APIError{Ret: 1205}, true},
+		{`wrapped rate limited`, fmt.Errorf(`send: %w`, ErrRateLimited), true},
+		{`logged out`, &APIError{Ret: 1101}, false},
+		{`unknown ret`, &APIError{Ret: 9999}, false},
+		{`timeout`, &url.Error{Op: `Get`, URL: `https://wx.qq.com`, Err: &net.DNSError{Err: `timeout`, IsTimeout: true}}, true},
+		{`deadline`, &url.Error{Op: `Get`, URL: `https://wx.qq.com`, Err: context.DeadlineExceeded}, true},
+		{`certificate`, &url.Error{Op: `Get`, URL: `https://wx.qq.com`, Err: x509.UnknownAuthorityError{}}, false},
+		{`no such host`, &url.Error{Op: `Get`, URL: `https://wx.qq.com`, Err: &net.DNSError{Err: `no such host`, IsNotFound: true}}, false},
+		{`plain error`, errors.New(`boom`), false},
+		{`nil`, nil, false},
+	}
+
+	for _, c := range cases {
+		if got := IsRetryable(c.err); got != c.want {
+			t.Errorf(`%s: IsRetryable = %v, want %v`, c.name, got, c.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package webot
 import (
 	"fmt"
 	"path"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,21 +28,78 @@ type EventContactData struct {
 
 // EventMsgData 新消息
 type EventMsgData struct {
-	MsgID	string `json:"msg_id"`
-	IsGroupMsg       bool    `json:"is_group_msg"`
-	IsMediaMsg       bool    `json:"is_media_msg"`
-	IsSendedByMySelf bool    `json:"is_sended_by_my_self"`
-	MsgType          int64 `json:"msg_type"`
-	AtMe             bool `json:"at_me"`
-	MediaURL         string `json:"media_url"`
-	Content          string `json:"content"`
-	FromUserName     string `json:"from_user_name"`
-	FromGGID         string `json:"from_ggid"`
-	SenderUserName   string `json:"sender_user_name"`
-	SenderGGID       string `json:"sender_ggid"`
-	ToUserName       string `json:"to_user_name"`
-	ToGGID           string `json:"to_ggid"`
-	OriginalMsg      map[string]interface{} `json:"original_msg"`
+	MsgID                  string                 `json:"msg_id"`
+	IsGroupMsg             bool                   `json:"is_group_msg"`
+	IsMediaMsg             bool                   `json:"is_media_msg"`
+	IsSendedByMySelf       bool                   `json:"is_sended_by_my_self"`
+	IsBackfill             bool                   `json:"is_backfill"` // 重新登录以后补收的断线期间的消息
+	MsgType                int64                  `json:"msg_type"`
+	CreateTime             int64                  `json:"create_time"`
+	AtMe                   bool                   `json:"at_me"`
+	Mentions               []string               `json:"mentions"` // 被 @ 的群成员 GGID, 不在联系人缓存中的成员为 UserName, @所有人 为 MentionAll
+	MediaURL               string                 `json:"media_url"`
+	MediaPath              string                 `json:"media_path"` // 开启 AutoDownloadMedia 后附件的保存位置
+	MediaID                string                 `json:"media_id"`   // 以下三项只有文件消息才有
+	FileName               string                 `json:"file_name"`
+	FileSize               int64                  `json:"file_size"`
+	VoiceLength            int64                  `json:"voice_length"` // 语音时长，单位毫秒
+	Transcript             string                 `json:"transcript"`   // 配置了 Transcriber 时语音识别的结果
+	Content                string                 `json:"content"`
+	ContentWithoutMentions string                 `json:"content_without_mentions"`
+	FromUserName           string                 `json:"from_user_name"`
+	FromGGID               string                 `json:"from_ggid"`
+	SenderUserName         string                 `json:"sender_user_name"`
+	SenderGGID             string                 `json:"sender_ggid"`
+	ToUserName             string                 `json:"to_user_name"`
+	ToGGID                 string                 `json:"to_ggid"`
+	OriginalMsg            map[string]interface{} `json:"original_msg"`
+}
+
+// chat 消息所在会话的 GGID, 群消息为群的 GGID
+func (data EventMsgData) chat() string {
+	if data.IsSendedByMySelf {
+		return data.ToGGID
+	}
+	return data.FromGGID
+}
+
+// text 消息的文字内容，语音消息为识别出的文字，群消息去掉了 @
+func (data EventMsgData) text() string {
+	if data.MsgType == 34 && len(data.Transcript) > 0 {
+		return data.Transcript
+	}
+	if data.IsGroupMsg {
+		return data.ContentWithoutMentions
+	}
+	return data.Content
+}
+
+// chatUserName 回复这条消息时应该发送的 UserName
+func (data EventMsgData) chatUserName() string {
+	if data.IsSendedByMySelf {
+		return data.ToUserName
+	}
+	return data.FromUserName
+}
+
+func (data EventMsgData) groupUserName() string {
+	if strings.HasPrefix(data.FromUserName, `@@`) {
+		return data.FromUserName
+	}
+	if strings.HasPrefix(data.ToUserName, `@@`) {
+		return data.ToUserName
+	}
+	return ``
+}
+
+// EventErrorData handler 返回错误或者 panic 时的详细信息
+type EventErrorData struct {
+	Pattern  string // 出错的 handler 注册路径
+	Path     string // 触发 handler 的事件路径
+	Err      error
+	IsPanic  bool
+	Stack    string // 仅 panic 时有值
+	Failures uint64 // 该 handler 累计失败次数
 }
 
 // EventTimerData ...
@@ -61,18 +119,28 @@ type evtStream struct {
 	stream      chan Event
 	wg          sync.WaitGroup
 	sigStopLoop chan Event
-	Handlers    map[string]func(Event)
+	Handlers    map[string]func(Event) error
 	hook        func(Event)
 	serverEvt   chan Event
+
+	fmu      sync.Mutex
+	failures map[string]uint64
+	onError  func(EventErrorData)
+
+	metrics *metrics
+	log     *botLogger
 }
 
-func newEvtStream() *evtStream {
+func newEvtStream(m *metrics, l *botLogger) *evtStream {
 	return &evtStream{
+		metrics:     m,
+		log:         l,
 		srcMap:      make(map[string]chan Event),
 		stream:      make(chan Event),
-		Handlers:    make(map[string]func(Event)),
+		Handlers:    make(map[string]func(Event) error),
 		sigStopLoop: make(chan Event),
 		serverEvt:   make(chan Event, 10),
+		failures:    make(map[string]uint64),
 	}
 }
 
@@ -120,7 +188,7 @@ func isPathMatch(pattern, path string) bool {
 	return len(path) >= n && path[0:n] == pattern
 }
 
-func findMatch(mux map[string]func(Event), path string) string {
+func findMatch(mux map[string]func(Event) error, path string) string {
 	n := -1
 	pattern := ""
 	for m := range mux {
@@ -139,13 +207,78 @@ func (es *evtStream) match(path string) string {
 	return findMatch(es.Handlers, path)
 }
 
+// safeCall 执行 handler, 捕获 panic 和返回的错误, 保证单个 handler 不会拖垮整个程序
+func (es *evtStream) safeCall(pattern string, evt Event, handler func(Event) error) {
+	start := time.Now()
+	defer func() {
+		es.metrics.observe(`webot_handler_duration_seconds`, labels(`pattern`, pattern), time.Since(start))
+		if r := recover(); r != nil {
+			es.reportError(pattern, evt, fmt.Errorf(`panic: %v`, r), true, string(debug.Stack()))
+		}
+	}()
+	if err := handler(evt); err != nil {
+		es.reportError(pattern, evt, err, false, ``)
+	}
+}
+
+func (es *evtStream) reportError(pattern string, evt Event, err error, isPanic bool, stack string) {
+
+	es.fmu.Lock()
+	es.failures[pattern]++
+	count := es.failures[pattern]
+	onError := es.onError
+	es.fmu.Unlock()
+
+	if isPanic {
+		es.log.Errorf("handler [%s] 处理 [%s] 时发生 panic: %v\n%s", pattern, evt.Path, err, stack)
+	} else {
+		es.log.Errorf(`handler [%s] 处理 [%s] 失败: %v`, pattern, evt.Path, err)
+	}
+
+	data := EventErrorData{
+		Pattern:  pattern,
+		Path:     evt.Path,
+		Err:      err,
+		IsPanic:  isPanic,
+		Stack:    stack,
+		Failures: count,
+	}
+
+	if onError != nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					es.log.Errorf(`OnError 回调发生 panic: %v`, r)
+				}
+			}()
+			onError(data)
+		}()
+	}
+
+	// /sys/error 的 handler 自己出错时不再产生新的事件, 防止死循环
+	if evt.Path == `/sys/error` {
+		return
+	}
+
+	go func() {
+		es.serverEvt <- Event{
+			Type: `Error`,
+			Path: `/sys/error`,
+			From: `Handler`,
+			To:   `End`,
+			Time: time.Now().Unix(),
+			Data: data,
+		}
+	}()
+}
+
 // Go 皮皮虾我们走
 func (wechat *WeChat) Go() {
 	es := wechat.evtStream
 
-	log.Debug(`------------开启微信程序，皮皮虾我们走...------------`)
+	wechat.log.Debug(`------------开启微信程序，皮皮虾我们走...------------`)
 	for k := range es.Handlers {
-		log.Debugf(k)
+		wechat.log.Debug(k)
 	}
 
 	for e := range es.stream {
@@ -153,15 +286,22 @@ func (wechat *WeChat) Go() {
 		case "/sig/stoploop":
 			return
 		}
+		es.metrics.inc(`webot_events_total`, labels(`path`, e.Path))
 		go func(a Event) {
+			wechat.applyRules(a)
 			es.RLock()
 			defer es.RUnlock()
 			if pattern := es.match(a.Path); pattern != "" {
-				es.Handlers[pattern](a)
+				es.safeCall(pattern, a, es.Handlers[pattern])
 			}
 		}(e)
+		go wechat.dispatchPlugins(e)
+		go wechat.applyBridges(e)
 		if es.hook != nil {
-			es.hook(e)
+			es.safeCall(`hook`, e, func(a Event) error {
+				es.hook(a)
+				return nil
+			})
 		}
 	}
 }
@@ -169,6 +309,8 @@ func (wechat *WeChat) Go() {
 // Stop 皮皮虾快停下
 func (wechat *WeChat) Stop() {
 	es := wechat.evtStream
+	wechat.shutdownPlugins()
+	wechat.stopRules()
 	go func() {
 		e := Event{
 			Path: "/sig/stoploop",
@@ -179,9 +321,38 @@ func (wechat *WeChat) Stop() {
 
 // Handle 处理消息，联系人，登录态 等等 所有东西
 func (wechat *WeChat) Handle(path string, handler func(Event)) {
+	wechat.HandleE(path, func(evt Event) error {
+		handler(evt)
+		return nil
+	})
+}
+
+// HandleE 同 Handle, handler 返回的 error 或者发生的 panic 会产生 /sys/error 事件
+func (wechat *WeChat) HandleE(path string, handler func(Event) error) {
 	wechat.evtStream.Handlers[cleanPath(path)] = handler
 }
 
+// OnError handler 出错或者 panic 时回调
+func (wechat *WeChat) OnError(f func(EventErrorData)) {
+	es := wechat.evtStream
+	es.fmu.Lock()
+	defer es.fmu.Unlock()
+	es.onError = f
+}
+
+// HandlerFailures 返回每个 handler 累计失败次数
+func (wechat *WeChat) HandlerFailures() map[string]uint64 {
+	es := wechat.evtStream
+	es.fmu.Lock()
+	defer es.fmu.Unlock()
+
+	failures := make(map[string]uint64, len(es.failures))
+	for k, v := range es.failures {
+		failures[k] = v
+	}
+	return failures
+}
+
 // Hook modify event on fly
 func (wechat *WeChat) Hook(f func(Event)) {
 	es := wechat.evtStream
@@ -225,7 +396,7 @@ func (wechat *WeChat) AddTimer(du time.Duration) {
 }
 
 // NewTimingCh ...
-func newTimingCh(hm string) chan Event {
+func newTimingCh(hm string, l *botLogger) chan Event {
 
 	infos := strings.Split(hm, `:`)
 	if len(infos) != 2 {
@@ -245,7 +416,7 @@ func newTimingCh(hm string) chan Event {
 			if n > 0 || hour > nh || (hour == nh && minute < nm) {
 				next = next.Add(time.Hour * 24)
 			}
-			log.Tracf(`下一次启动时间 %v ... `, next)
+			l.Tracf(`下一次启动时间 %v ... `, next)
 			n++
 			time.Sleep(next.Sub(now))
 			e := Event{}
@@ -262,7 +433,21 @@ func newTimingCh(hm string) chan Event {
 
 // AddTiming ...
 func (wechat *WeChat) AddTiming(hm string) {
-	wechat.evtStream.merge(`timing`, newTimingCh(hm))
+	wechat.evtStream.merge(`timing`, newTimingCh(hm, wechat.log))
+}
+
+func (wechat *WeChat) emit(evtType, from, path string, data interface{}) {
+	event := Event{
+		Type: evtType,
+		From: from,
+		Path: path,
+		To:   `End`,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+	go func() {
+		wechat.evtStream.serverEvt <- event
+	}()
 }
 
 func (es *evtStream) emitContactChangeEvent(ggid string, ct int) {
@@ -285,7 +470,8 @@ func (es *evtStream) emitContactChangeEvent(ggid string, ct int) {
 	es.serverEvt <- event
 }
 
-func (wechat *WeChat) emitNewMessageEvent(m map[string]interface{}) {
+// emitNewMessageEvent 返回消息是否产生了事件
+func (wechat *WeChat) emitNewMessageEvent(m map[string]interface{}, isBackfill bool) bool {
 
 	fromUserName := m[`FromUserName`].(string)
 	senderUserName := fromUserName
@@ -305,6 +491,10 @@ func (wechat *WeChat) emitNewMessageEvent(m map[string]interface{}) {
 	}
 	msgType := m[`MsgType`].(float64)
 	mid := m[`MsgId`].(string)
+	createTime, _ := m[`CreateTime`].(float64)
+	wechat.lastMsg.mark(int64(createTime), mid)
+	wechat.health.mark(&wechat.health.lastMsgReceived)
+	wechat.metrics.inc(`webot_messages_received_total`, labels(`type`, fmt.Sprint(int64(msgType))))
 
 	isMediaMsg := false
 	mediaURL := ``
@@ -327,49 +517,91 @@ func (wechat *WeChat) emitNewMessageEvent(m map[string]interface{}) {
 		isMediaMsg = true
 		mediaURL = fmt.Sprintf(`%v/%s?msgid=%v&%v`, wechat.BaseURL, path, mid, wechat.SkeyKV())
 	}
-	isAtMe := false
-	if isGroupMsg && !isSendedByMySelf {
-		atme := `@`
-		if len(wechat.MySelf.DisplayName) > 0 {
-			atme += wechat.MySelf.DisplayName
-		} else {
-			atme += wechat.MySelf.NickName
-		}
-		isAtMe = strings.Contains(content, atme)
 
-		infos := strings.Split(content, `:<br/>`)
+	mediaID, fileName, fileSize := ``, ``, int64(0)
+	if isAttachment(m) {
+		isMediaMsg = true
+		mediaID, _ = m[`MediaId`].(string)
+		fileName, _ = m[`FileName`].(string)
+		fs, _ := m[`FileSize`].(string)
+		fileSize, _ = strconv.ParseInt(fs, 10, 64)
+		mediaURL = wechat.attachmentURL(fromUserName, mediaID, fileName)
+	}
+	if isGroupMsg && !isSendedByMySelf {
+		infos := strings.SplitN(content, `:<br/>`, 2)
 		if len(infos) != 2 {
-			return
+			return false
 		}
 
 		contact, err := wechat.ContactByUserName(infos[0])
 		if err != nil {
 			wechat.ForceUpdateGroup(groupUserName)
-			log.Errorf(`找不到联系人信息，忽略此消息 %s ...`, m)
-			return
+			wechat.log.Errorf(`找不到联系人信息，忽略此消息 [%s] ...`, mid)
+			return false
 		}
 
 		senderUserName = contact.UserName
 		content = infos[1]
 	}
+	content = normalizeContent(content)
+
+	isAtMe := false
+	var mentions []string
+	contentWithoutMentions := content
+	if isGroupMsg {
+		if group, err := wechat.cache.contactByUserName(groupUserName); err == nil {
+			var members []*Contact
+			members, contentWithoutMentions = parseMentions(group, content)
+			for _, member := range members {
+				if member == mentionAllMember {
+					mentions = append(mentions, MentionAll)
+					continue
+				}
+				if member.UserName == wechat.MySelf.UserName && !isSendedByMySelf {
+					isAtMe = true
+				}
+				ggid := member.GGID
+				if len(ggid) == 0 {
+					ggid = wechat.cache.userGG[member.UserName]
+				}
+				// 没有 GGID 的成员使用 UserName，SendGroupText 同样可以使用
+				if len(ggid) == 0 {
+					ggid = member.UserName
+				}
+				mentions = append(mentions, ggid)
+			}
+		}
+	}
 
 	data := EventMsgData{
-		MsgID: m[`MsgId`].(string),
-		IsGroupMsg:       isGroupMsg,
-		IsMediaMsg:       isMediaMsg,
-		IsSendedByMySelf: isSendedByMySelf,
-		MsgType:          int64(msgType),
-		AtMe:             isAtMe,
-		MediaURL:         mediaURL,
-		Content:          content,
-		FromUserName:     fromUserName,
-		FromGGID:         wechat.cache.userGG[fromUserName], // TODO 不应该直接从字典里取
-		SenderUserName:   senderUserName,
-		SenderGGID:       wechat.cache.userGG[senderUserName],
-		ToUserName:       toUserName,
-		ToGGID:           wechat.cache.userGG[toUserName],
-		OriginalMsg:      m,
+		MsgID:                  m[`MsgId`].(string),
+		IsGroupMsg:             isGroupMsg,
+		IsMediaMsg:             isMediaMsg,
+		IsSendedByMySelf:       isSendedByMySelf,
+		IsBackfill:             isBackfill,
+		MsgType:                int64(msgType),
+		CreateTime:             int64(createTime),
+		AtMe:                   isAtMe,
+		Mentions:               mentions,
+		MediaURL:               mediaURL,
+		MediaID:                mediaID,
+		FileName:               fileName,
+		FileSize:               fileSize,
+		Content:                content,
+		ContentWithoutMentions: contentWithoutMentions,
+		FromUserName:           fromUserName,
+		FromGGID:               wechat.cache.userGG[fromUserName], // TODO 不应该直接从字典里取
+		SenderUserName:         senderUserName,
+		SenderGGID:             wechat.cache.userGG[senderUserName],
+		ToUserName:             toUserName,
+		ToGGID:                 wechat.cache.userGG[toUserName],
+		OriginalMsg:            m,
 	}
+	if msgType == 34 {
+		vl, _ := m[`VoiceLength`].(float64)
+		data.VoiceLength = int64(vl)
+	}
+
 	evtPath := `/solo`
 	if isGroupMsg {
 		evtPath = `/group`
@@ -382,10 +614,37 @@ func (wechat *WeChat) emitNewMessageEvent(m map[string]interface{}) {
 		Time: time.Now().Unix(),
 		Data: data,
 	}
+
+	// 补收的消息在 backfillQueue 中识别和下载，不阻塞同步
+	if isBackfill {
+		wechat.backfillEvt <- event
+		return true
+	}
+
+	wechat.prepareMsg(&data)
+	event.Data = data
 	wechat.evtStream.serverEvt <- event
+	return true
 }
 
-func (wechat *WeChat) handleServerEvent(resp *syncMessageResponse) {
+// prepareMsg 语音识别和自动下载附件，可能需要较长时间
+func (wechat *WeChat) prepareMsg(data *EventMsgData) {
+
+	if data.MsgType == 34 && wechat.conf.Transcriber != nil {
+		wechat.transcribe(data)
+	}
+
+	if data.IsMediaMsg && wechat.conf.AutoDownloadMedia {
+		if mediaPath, err := wechat.DownloadMsgMedia(*data); err != nil {
+			wechat.log.Errorf(`自动下载附件失败 [%s]: %v`, data.MsgID, err)
+		} else {
+			data.MediaPath = mediaPath
+		}
+	}
+}
+
+// handleServerEvent 补收消息时 backfill 不为空，返回产生的新消息数目
+func (wechat *WeChat) handleServerEvent(resp *syncMessageResponse, backfill *syncPoint) int {
 
 	es := wechat.evtStream
 
@@ -403,9 +662,24 @@ func (wechat *WeChat) handleServerEvent(resp *syncMessageResponse) {
 		}
 	}
 
+	count := 0
 	if resp.AddMsgCount > 0 {
 		for _, v := range resp.AddMsgList {
-			go wechat.emitNewMessageEvent(v)
+			if backfill == nil {
+				go wechat.emitNewMessageEvent(v, false)
+				continue
+			}
+			// 断线前已经处理过
+			ct, _ := v[`CreateTime`].(float64)
+			mid, _ := v[`MsgId`].(string)
+			if !msgAfter(int64(ct), mid, backfill.LastMsgTime, backfill.LastMsgID) {
+				continue
+			}
+			// 补收的消息按顺序进入 backfillQueue，只统计真正发出的消息
+			if wechat.emitNewMessageEvent(v, true) {
+				count++
+			}
 		}
 	}
+	return count
 }
@@ -0,0 +1,155 @@
+package webot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/num5/webot/messages"
+)
+
+type bridgeManager struct {
+	sync.RWMutex
+	links map[string]map[string]bool // 群 GGID => 需要同步的群 GGID
+}
+
+func newBridgeManager() *bridgeManager {
+	return &bridgeManager{
+		links: make(map[string]map[string]bool),
+	}
+}
+
+// Forward 将收到的消息原样转发给 to (UserName)
+func (wechat *WeChat) Forward(msg EventMsgData, to string) error {
+
+	switch msg.MsgType {
+	case 1:
+		return wechat.SendTextMsg(msg.Content, to)
+	case 49:
+		// 文件消息可以直接复用 MediaId，不需要重新上传
+		if len(msg.MediaID) > 0 && len(msg.FileName) > 0 {
+			ext := strings.TrimPrefix(filepath.Ext(msg.FileName), `.`)
+			return wechat.SendMsg(messages.NewFileMsgWithSize(msg.MediaID, to, msg.FileName, ext, msg.FileSize))
+		}
+		// 链接、小程序等卡片直接重发 appmsg
+		if len(msg.Content) > 0 {
+			return wechat.SendMsg(messages.NewAppMsg(msg.Content, to))
+		}
+	}
+
+	if msg.IsMediaMsg && len(msg.MediaURL) > 0 {
+		buf := new(bytes.Buffer)
+		if _, err := wechat.DownloadTo(msg.MediaURL, buf); err != nil {
+			return err
+		}
+		return wechat.sendReader(buf, msg.MsgID, to, nil)
+	}
+
+	return fmt.Errorf(`unsupported msg type [%d] for forward`, msg.MsgType)
+}
+
+// Bridge 在两个群之间同步所有消息, a 和 b 为群的 GGID
+func (wechat *WeChat) Bridge(a, b string) error {
+
+	if a == b {
+		return errors.New(`can't bridge a group to itself`)
+	}
+	for _, ggid := range []string{a, b} {
+		c, err := wechat.ContactByGGID(ggid)
+		if err != nil {
+			return err
+		}
+		if c.Type != Group {
+			return fmt.Errorf(`[%s] is not a group`, c.NickName)
+		}
+	}
+
+	bm := wechat.bridges
+	bm.Lock()
+	defer bm.Unlock()
+
+	bm.link(a, b)
+	bm.link(b, a)
+
+	return nil
+}
+
+// Unbridge 取消两个群之间的消息同步
+func (wechat *WeChat) Unbridge(a, b string) {
+
+	bm := wechat.bridges
+	bm.Lock()
+	defer bm.Unlock()
+
+	delete(bm.links[a], b)
+	delete(bm.links[b], a)
+}
+
+func (bm *bridgeManager) link(from, to string) {
+	if bm.links[from] == nil {
+		bm.links[from] = make(map[string]bool)
+	}
+	bm.links[from][to] = true
+}
+
+func (wechat *WeChat) applyBridges(evt Event) {
+
+	msg, ok := evt.Data.(EventMsgData)
+	// 自己发出的消息不再同步，防止两个群之间无限循环
+	if !ok || !msg.IsGroupMsg || msg.IsSendedByMySelf {
+		return
+	}
+
+	bm := wechat.bridges
+	bm.RLock()
+	var targets []string
+	for ggid := range bm.links[msg.FromGGID] {
+		targets = append(targets, ggid)
+	}
+	bm.RUnlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	prefix := fmt.Sprintf(`[%s] `, wechat.memberName(msg.FromUserName, msg.SenderUserName))
+
+	for _, ggid := range targets {
+		ggid := ggid
+		wechat.evtStream.safeCall(`bridge:`+ggid, evt, func(Event) error {
+			group, err := wechat.ContactByGGID(ggid)
+			if err != nil {
+				return err
+			}
+			if msg.MsgType == 1 {
+				return wechat.SendTextMsg(prefix+msg.Content, group.UserName)
+			}
+			if err = wechat.SendTextMsg(prefix+`:`, group.UserName); err != nil {
+				return err
+			}
+			return wechat.Forward(msg, group.UserName)
+		})
+	}
+}
+
+// memberName 群成员在群里的显示名称，没有群昵称时使用昵称
+func (wechat *WeChat) memberName(groupUserName, userName string) string {
+
+	members, _ := wechat.MembersOfGroup(groupUserName)
+	for _, m := range members {
+		if m.UserName == userName {
+			if name := memberDisplayName(m); len(name) > 0 {
+				return name
+			}
+		}
+	}
+
+	if c, err := wechat.ContactByUserName(userName); err == nil {
+		return c.NickName
+	}
+
+	return userName
+}
@@ -0,0 +1,144 @@
+package webot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health 机器人运行状态快照
+type Health struct {
+	Healthy         bool      `json:"healthy"` // 已登录并且同步没有超过 StaleThreshold
+	IsLogin         bool      `json:"is_login"`
+	SyncHost        string    `json:"sync_host"`
+	LastSyncCheck   time.Time `json:"last_sync_check"`
+	LastSync        time.Time `json:"last_sync"`
+	LastMsgReceived time.Time `json:"last_msg_received"`
+	LastMsgSent     time.Time `json:"last_msg_sent"`
+	Contacts        int       `json:"contacts"`
+}
+
+// EventStaleData /sys/stale 事件，同步长时间没有响应时产生，掉线以后一直没能重新登录时同样会产生
+type EventStaleData struct {
+	LastSyncCheck time.Time
+	Since         time.Duration
+	IsLogin       bool
+}
+
+type healthMonitor struct {
+	sync.RWMutex
+	isLogin         bool
+	syncHost        string
+	lastSyncCheck   time.Time
+	lastSync        time.Time
+	lastMsgReceived time.Time
+	lastMsgSent     time.Time
+}
+
+func (hm *healthMonitor) mark(t *time.Time) {
+	hm.Lock()
+	*t = time.Now()
+	hm.Unlock()
+}
+
+// setLogin 和 setSyncHost 记录 Health 需要的状态，HealthHandler 在其他 goroutine 中读取
+func (hm *healthMonitor) setLogin(isLogin bool) {
+	hm.Lock()
+	hm.isLogin = isLogin
+	hm.Unlock()
+}
+
+func (hm *healthMonitor) setSyncHost(host string) {
+	hm.Lock()
+	hm.syncHost = host
+	hm.Unlock()
+}
+
+// Health 返回当前的运行状态
+func (wechat *WeChat) Health() Health {
+
+	hm := wechat.health
+	hm.RLock()
+	h := Health{
+		IsLogin:         hm.isLogin,
+		SyncHost:        hm.syncHost,
+		LastSyncCheck:   hm.lastSyncCheck,
+		LastSync:        hm.lastSync,
+		LastMsgReceived: hm.lastMsgReceived,
+		LastMsgSent:     hm.lastMsgSent,
+	}
+	hm.RUnlock()
+
+	wechat.cache.Lock()
+	h.Contacts = len(wechat.cache.ggmap)
+	wechat.cache.Unlock()
+
+	h.Healthy = h.IsLogin && !wechat.isStale(h.LastSyncCheck)
+
+	return h
+}
+
+func (wechat *WeChat) isStale(lastSyncCheck time.Time) bool {
+	threshold := wechat.conf.StaleThreshold
+	return threshold > 0 && time.Since(lastSyncCheck) > threshold
+}
+
+// HealthHandler 以 JSON 返回 Health()，不健康时状态码为 503，可以挂载到 /healthz
+func (wechat *WeChat) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := wechat.Health()
+		w.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
+
+// monitorHealth 定时发送心跳，同步长时间没有响应时产生 /sys/stale 事件
+//
+// 没有登录时同样检查，掉线以后一直没能重新登录也会产生 /sys/stale 事件
+func (wechat *WeChat) monitorHealth() {
+
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+
+	started := time.Now()
+	lastBeat, alerted := started, false
+
+	for now := range tick.C {
+
+		h := wechat.Health()
+
+		if hb := wechat.conf.Heartbeat; h.IsLogin && hb > 0 && now.Sub(lastBeat) >= hb {
+			lastBeat = now
+			if err := wechat.SendTextMsg(fmt.Sprintf(`[webot] heartbeat %s`, now.Format(`2006-01-02 15:04:05`)), `filehelper`); err != nil {
+				wechat.log.Errorf(`发送心跳失败: %v`, err)
+			}
+		}
+
+		// 还没有同步过时从启动开始计算
+		last := h.LastSyncCheck
+		if last.Before(started) {
+			last = started
+		}
+		if !wechat.isStale(last) {
+			alerted = false
+			continue
+		}
+		if alerted {
+			continue
+		}
+		alerted = true
+
+		since := now.Sub(last)
+		if h.IsLogin {
+			wechat.log.Warnf(`已经 %v 没有同步成功 ...`, since)
+		} else {
+			wechat.log.Warnf(`已经 %v 没有登录成功 ...`, since)
+		}
+		wechat.emit(`Health`, `Wechat`, `/sys/stale`, EventStaleData{LastSyncCheck: h.LastSyncCheck, Since: since, IsLogin: h.IsLogin})
+	}
+}
@@ -0,0 +1,177 @@
+package webot
+
+import (
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Logger 日志接口，通过 Configure.Logger 注入
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// FieldLogger 支持结构化字段的 Logger，登录以后会通过 With 附加 uin 和 nickname
+type FieldLogger interface {
+	Logger
+	With(args ...interface{}) Logger
+}
+
+// NewStdLogger 使用标准库 log 输出到 w, w 为空时输出到 os.Stderr
+func NewStdLogger(w io.Writer) Logger {
+	if w == nil {
+		w = os.Stderr
+	}
+	return &stdLogger{stdlog.New(w, `[webot] `, stdlog.LstdFlags)}
+}
+
+type stdLogger struct {
+	l *stdlog.Logger
+}
+
+func (sl *stdLogger) Debugf(format string, args ...interface{}) {
+	sl.l.Printf(`[DEBUG] `+format, args...)
+}
+
+func (sl *stdLogger) Infof(format string, args ...interface{}) {
+	sl.l.Printf(`[INFO] `+format, args...)
+}
+
+func (sl *stdLogger) Warnf(format string, args ...interface{}) {
+	sl.l.Printf(`[WARN] `+format, args...)
+}
+
+func (sl *stdLogger) Errorf(format string, args ...interface{}) {
+	sl.l.Printf(`[ERROR] `+format, args...)
+}
+
+// 日志中需要隐藏的登录凭证
+var (
+	secretParam  = regexp.MustCompile(`(?i)\b(skey|pass_ticket|passticket|webwx_data_ticket|wxsid|sid)(["']?\s*[=:]\s*["']?)([^&\s"',\]}]+)`)
+	secretCookie = regexp.MustCompile(`(?i)\b(cookies?["']?\s*[=:]\s*)([^\r\n]*)`)
+)
+
+func redact(s string) string {
+	s = secretCookie.ReplaceAllString(s, `${1}***`)
+	return secretParam.ReplaceAllString(s, `${1}${2}***`)
+}
+
+// botLogger 包装 Logger：过滤调试日志、隐藏登录凭证、附加机器人的字段
+type botLogger struct {
+	sync.RWMutex
+	base   Logger
+	l      Logger
+	prefix string
+	debug  bool
+}
+
+func newBotLogger(l Logger, debug bool) *botLogger {
+	if l == nil {
+		l = NewStdLogger(nil)
+	}
+	return &botLogger{base: l, l: l, debug: debug}
+}
+
+// setFields 替换附加的字段，args 为 key, value 成对出现
+func (bl *botLogger) setFields(args ...interface{}) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	if fl, ok := bl.base.(FieldLogger); ok {
+		bl.l = fl.With(args...)
+		return
+	}
+
+	bl.prefix = ``
+	for i := 0; i+1 < len(args); i += 2 {
+		bl.prefix += fmt.Sprintf(`%v=%v `, args[i], args[i+1])
+	}
+	if len(bl.prefix) > 0 {
+		bl.prefix = `[` + bl.prefix[:len(bl.prefix)-1] + `] `
+	}
+}
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (bl *botLogger) output(level int, format string, args ...interface{}) {
+
+	bl.RLock()
+	l, prefix := bl.l, bl.prefix
+	bl.RUnlock()
+
+	msg := prefix + redact(fmt.Sprintf(format, args...))
+
+	switch level {
+	case levelDebug:
+		l.Debugf(`%s`, msg)
+	case levelInfo:
+		l.Infof(`%s`, msg)
+	case levelWarn:
+		l.Warnf(`%s`, msg)
+	default:
+		l.Errorf(`%s`, msg)
+	}
+}
+
+func (bl *botLogger) Debugf(format string, args ...interface{}) {
+	if bl.debug {
+		bl.output(levelDebug, format, args...)
+	}
+}
+
+func (bl *botLogger) Debug(args ...interface{}) { bl.Debugf(`%s`, fmt.Sprint(args...)) }
+
+// Tracf 同 Debugf
+func (bl *botLogger) Tracf(format string, args ...interface{}) { bl.Debugf(format, args...) }
+
+func (bl *botLogger) Trac(args ...interface{}) { bl.Debugf(`%s`, fmt.Sprint(args...)) }
+
+func (bl *botLogger) Infof(format string, args ...interface{}) {
+	bl.output(levelInfo, format, args...)
+}
+
+func (bl *botLogger) Info(args ...interface{}) { bl.Infof(`%s`, fmt.Sprint(args...)) }
+
+func (bl *botLogger) Warnf(format string, args ...interface{}) {
+	bl.output(levelWarn, format, args...)
+}
+
+func (bl *botLogger) Warn(args ...interface{}) { bl.Warnf(`%s`, fmt.Sprint(args...)) }
+
+func (bl *botLogger) Errorf(format string, args ...interface{}) {
+	bl.output(levelError, format, args...)
+}
+
+func (bl *botLogger) Error(args ...interface{}) { bl.Errorf(`%s`, fmt.Sprint(args...)) }
+
+// processorLogger 内置的 UUIDProcessor 使用机器人的 logger
+type processorLogger struct {
+	log *botLogger
+}
+
+func (pl *processorLogger) setLogger(l *botLogger) {
+	pl.log = l
+}
+
+func (pl *processorLogger) logger() *botLogger {
+	if pl.log == nil {
+		return newBotLogger(nil, false)
+	}
+	return pl.log
+}
+
+// loggerSetter 实现了该接口的 Processor 会在创建机器人时收到机器人的 logger
+type loggerSetter interface {
+	setLogger(l *botLogger)
+}
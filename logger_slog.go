@@ -0,0 +1,40 @@
+//go:build go1.21
+
+package webot
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// NewSlogLogger 使用 log/slog 输出，l 为空时使用 slog.Default()
+func NewSlogLogger(l *slog.Logger) FieldLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (sl *slogLogger) Debugf(format string, args ...interface{}) {
+	sl.l.Debug(fmt.Sprintf(format, args...))
+}
+
+func (sl *slogLogger) Infof(format string, args ...interface{}) {
+	sl.l.Info(fmt.Sprintf(format, args...))
+}
+
+func (sl *slogLogger) Warnf(format string, args ...interface{}) {
+	sl.l.Warn(fmt.Sprintf(format, args...))
+}
+
+func (sl *slogLogger) Errorf(format string, args ...interface{}) {
+	sl.l.Error(fmt.Sprintf(format, args...))
+}
+
+func (sl *slogLogger) With(args ...interface{}) Logger {
+	return &slogLogger{sl.l.With(args...)}
+}
@@ -0,0 +1,34 @@
+package webot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+
+	cases := []struct {
+		in, out string
+	}{
+		{`GET /cgi-bin/mmwebwx-bin/webwxinit?r=1&skey=@crypt_abc&pass_ticket=xyz%2B1 HTTP/1.1`, `GET /cgi-bin/mmwebwx-bin/webwxinit?r=1&skey=***&pass_ticket=*** HTTP/1.1`},
+		{`{"Uin":123,"Sid":"s1d","Skey":"@crypt_abc","DeviceID":"e1"}`, `{"Uin":123,"Sid":"***","Skey":"***","DeviceID":"e1"}`},
+		{`webwx_data_ticket=gSd9+/x&wxsid=abc`, `webwx_data_ticket=***&wxsid=***`},
+		{`PassTicket: 'tk'`, `PassTicket: '***'`},
+		{"Host: wx.qq.com\r\nCookie: wxuin=1; wxsid=abc\r\nAccept: */*", "Host: wx.qq.com\r\nCookie: ***\r\nAccept: */*"},
+		{`cookies: [wxsid=abc webwx_data_ticket=def]`, `cookies: ***`},
+		{`uuid=4ZxyQ== tip=1`, `uuid=4ZxyQ== tip=1`},
+		{`同步失败: webot: synccheck ret=1101`, `同步失败: webot: synccheck ret=1101`},
+	}
+
+	for _, c := range cases {
+		out := redact(c.in)
+		if out != c.out {
+			t.Errorf(`redact(%q) = %q, want %q`, c.in, out, c.out)
+		}
+		for _, secret := range []string{`@crypt_abc`, `xyz`, `gSd9`, `s1d`} {
+			if strings.Contains(out, secret) {
+				t.Errorf(`redact(%q) leaks %q`, c.in, secret)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package webot
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -21,6 +22,22 @@ type UUIDProcessor interface {
 	UUIDDidConfirm(err error)
 }
 
+// LoginObserver UUIDProcessor 同时实现该接口时可以收到扫码过程中的状态变化
+type LoginObserver interface {
+	// Scanned 已扫码，等待手机确认，avatar 为扫码用户的头像
+	Scanned(avatar []byte)
+	// Expired 二维码过期
+	Expired()
+	// Refreshed 二维码过期以后重新获取了 uuid 并再次调用了 ProcessUUID
+	Refreshed(uuid string)
+}
+
+// EventLoginData /pushlogin/sent /pushlogin/confirmed /qrlogin/scanned /qrlogin/expired /qrlogin/refreshed /qrlogin/confirmed 事件
+type EventLoginData struct {
+	UUID   string
+	Avatar []byte // 只有 /qrlogin/scanned 事件才有
+}
+
 type initRequest struct {
 	BaseRequest *BaseRequest
 }
@@ -29,7 +46,7 @@ type initResp struct {
 	Response
 	User    Contact
 	Skey    string
-	SyncKey map[string]interface{}
+	SyncKey *SyncKey
 }
 
 func (wechat *WeChat) reLogin() error {
@@ -52,13 +69,16 @@ func (wechat *WeChat) reLogin() error {
 // run is used to login to wechat server. Need end user scan orcode.
 func (wechat *WeChat) beginLoginFlow() error {
 
-	log.Info(`准备登陆参数，请稍等片刻 ... ...`)
+	wechat.log.Info(`准备登陆参数，请稍等片刻 ... ...`)
+
+	// 登录过程中会覆盖缓存，先取出上一次的同步点
+	point := wechat.cachedSyncPoint()
 
 	cached, err := wechat.cachedInfo()
 
 	if err == nil {
 
-		log.Info(`尝试恢复登陆 ...`)
+		wechat.log.Info(`尝试恢复登陆 ...`)
 
 		wechat.BaseURL = cached[`baseURL`].(string)
 		wechat.BaseRequest = cached[`baseRequest`].(*BaseRequest)
@@ -69,50 +89,149 @@ func (wechat *WeChat) beginLoginFlow() error {
 		}
 		wechat.Client.Jar.SetCookies(u, cookies)
 
+		if host, ok := cached[`syncHost`].(string); ok {
+			wechat.syncHost = host
+			wechat.health.setSyncHost(host)
+		}
+
 		err = wechat.init()
-		if err != nil {
-			deleteFile(wechat.conf.cookieCachePath())
+		if err == nil {
+			wechat.resumeSyncPoint(point)
+			return nil
+		}
+	}
+	wechat.log.Errorf("恢复登录失败：%s ...", err.Error())
+
+	// 会话已经失效，cookie 缓存保留到推送登录被拒绝为止，重连时新的 Client 还需要用到
+	redirectURL := ``
+	if wechat.conf.PushLogin {
+		if redirectURL, err = wechat.pushLogin(); err != nil {
+			wechat.log.Warnf(`推送登录失败: %v, 使用二维码登录 ...`, err)
+			if pushRejected(err) {
+				deleteFile(wechat.conf.cookieCachePath())
+			}
+		}
+	} else {
+		deleteFile(wechat.conf.cookieCachePath())
+	}
+
+	if len(redirectURL) == 0 {
+		if redirectURL, err = wechat.qrLogin(); err != nil {
+			return err
 		}
+	}
+
+	req, _ := http.NewRequest(`GET`, redirectURL, nil)
+
+	// 4.
+	if err = wechat.login(req); err != nil {
+		return err
+	}
 
+	if err = wechat.init(); err != nil {
 		return err
 	}
-	log.Errorf("恢复登录失败：%s ...", err.Error())
+
+	wechat.resumeSyncPoint(point)
+
+	return nil
+}
+
+// qrLogin 扫码登录，返回确认以后的跳转地址
+func (wechat *WeChat) qrLogin() (string, error) {
 
 	// 1.
-	uuid, e := wechat.fetchUUID()
+	uuid, err := wechat.fetchUUID()
 
-	if e != nil {
-		return e
+	if err != nil {
+		return ``, err
 	}
 
 	// 2.
-	err = wechat.conf.Processor.ProcessUUID(uuid,wechat.conf.Storage)
+	err = wechat.conf.Processor.ProcessUUID(uuid, wechat.conf.Storage)
 
 	if err != nil {
-		return err
+		return ``, err
 	}
 
 	// 3.
-	redirectURL, code, tip := ``, ``, 1
+	redirectURL, err := wechat.waitForScan(uuid)
+	wechat.conf.Processor.UUIDDidConfirm(err)
 
-	for code != httpOK {
-		redirectURL, code, tip, err = wechat.waitConfirmUUID(uuid, tip)
-		if err != nil {
-			wechat.conf.Processor.UUIDDidConfirm(err)
-			return err
-		}
+	return redirectURL, err
+}
+
+type pushLoginResp struct {
+	Ret  string `json:"ret"`
+	Msg  string `json:"msg"`
+	UUID string `json:"uuid"`
+}
+
+// pushLoginTimeout 等待手机确认推送登录的时间
+const pushLoginTimeout = 2 * time.Minute
+
+// errPushLoginExpired 手机上没有确认推送登录
+var errPushLoginExpired = errors.New(`push login expired`)
+
+// pushRejected 推送登录被服务器拒绝或者没有确认，缓存的 cookie 已经没有用了，网络错误不算
+func pushRejected(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) || errors.Is(err, errPushLoginExpired)
+}
+
+// pushLogin 使用缓存中的 uin 向手机推送登录确认，不需要重新扫码
+func (wechat *WeChat) pushLogin() (string, error) {
+
+	baseInfo, err := wechat.cachedBaseInfo()
+	if err != nil {
+		return ``, err
 	}
 
-	wechat.conf.Processor.UUIDDidConfirm(nil)
+	baseURL, _ := baseInfo[`baseURL`].(string)
+	bqInfo, _ := baseInfo[`baseRequest`].(map[string]interface{})
+	uin, _ := bqInfo[`Uin`].(float64)
+	if len(baseURL) == 0 || uin == 0 {
+		return ``, errors.New(`no cached uin`)
+	}
 
-	req, _ := http.NewRequest(`GET`, redirectURL, nil)
+	resp, err := wechat.Client.Get(fmt.Sprintf(`%s/webwxpushloginurl?uin=%d`, baseURL, int64(uin)))
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
 
-	// 4.
-	if err = wechat.login(req); err != nil {
-		return err
+	var result pushLoginResp
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ``, err
+	}
+	if result.Ret != `0` || len(result.UUID) == 0 {
+		ret, _ := strconv.Atoi(result.Ret)
+		return ``, &APIError{Ret: ret, ErrMsg: result.Msg, Endpoint: `webwxpushloginurl`}
 	}
 
-	return wechat.init()
+	wechat.log.Info(`已向手机发送登录确认，请在手机上点击登录 ...`)
+	wechat.emit(`Login`, `Wechat`, `/pushlogin/sent`, EventLoginData{UUID: result.UUID})
+
+	tip := 1
+	for deadline := time.Now().Add(pushLoginTimeout); time.Now().Before(deadline); {
+		redirectURL, code, _, rt, err := wechat.waitConfirmUUID(result.UUID, tip)
+		if err != nil {
+			return ``, err
+		}
+		tip = rt
+
+		switch code {
+		case httpOK:
+			wechat.emit(`Login`, `Wechat`, `/pushlogin/confirmed`, EventLoginData{UUID: result.UUID})
+			return redirectURL, nil
+		case `201`, `408`:
+			// 等待手机确认
+		default:
+			return ``, fmt.Errorf(`%w: %s`, errPushLoginExpired, code)
+		}
+	}
+
+	return ``, fmt.Errorf(`%w: timeout`, errPushLoginExpired)
 }
 
 func (wechat *WeChat) cachedInfo() (map[string]interface{}, error) {
@@ -145,7 +264,7 @@ func (wechat *WeChat) cachedInfo() (map[string]interface{}, error) {
 
 	baseInfo[`baseRequest`] = bq
 
-	if err != nil || len(baseInfo) != 3 {
+	if err != nil || len(baseInfo) < 3 {
 		return nil, errors.New(`cached baseInfo is invalidate`)
 	}
 
@@ -191,8 +310,8 @@ func (wechat *WeChat) fetchUUID() (string, error) {
 	}
 
 	if code != httpOK {
-		err = fmt.Errorf("error code is unexpect:[%s], api result:[%s]", code, ds)
-		return ``, err
+		ret, _ := strconv.Atoi(code)
+		return ``, &APIError{Ret: ret, ErrMsg: abbreviate(ds), Endpoint: `jslogin`}
 	}
 
 	uuid, err := search(ds, `window.QRLogin.uuid = "`, `";`)
@@ -203,10 +322,67 @@ func (wechat *WeChat) fetchUUID() (string, error) {
 	return uuid, nil
 }
 
-func (wechat *WeChat) waitConfirmUUID(uuid string, tip int) (redirectURI, code string, rt int, err error) {
+// waitForScan 等待扫码确认，二维码过期以后自动刷新
+func (wechat *WeChat) waitForScan(uuid string) (string, error) {
+
+	observer, _ := wechat.conf.Processor.(LoginObserver)
+
+	tip, refreshed, scanned := 1, 0, false
 
-	loginURL, rt := fmt.Sprintf("https://login.weixin.qq.com/cgi-bin/mmwebwx-bin/login?tip=%d&uuid=%s&_=%s", tip, uuid, strconv.FormatInt(time.Now().Unix(), 10)), tip
-	resp, err := wechat.Client.Get(loginURL)
+	for {
+		redirectURL, code, avatar, rt, err := wechat.waitConfirmUUID(uuid, tip)
+		if err != nil {
+			return ``, err
+		}
+		tip = rt
+
+		switch code {
+		case httpOK:
+			wechat.emit(`Login`, `Wechat`, `/qrlogin/confirmed`, EventLoginData{UUID: uuid})
+			return redirectURL, nil
+		case `201`:
+			if scanned {
+				continue
+			}
+			scanned = true
+			if observer != nil {
+				observer.Scanned(avatar)
+			}
+			wechat.emit(`Login`, `Wechat`, `/qrlogin/scanned`, EventLoginData{UUID: uuid, Avatar: avatar})
+		case `408`:
+			// 长轮询超时，二维码仍然有效
+		default:
+			wechat.log.Warnf(`二维码已过期 [%s] ...`, code)
+			if observer != nil {
+				observer.Expired()
+			}
+			wechat.emit(`Login`, `Wechat`, `/qrlogin/expired`, EventLoginData{UUID: uuid})
+
+			if refreshed >= wechat.conf.QRRefresh {
+				return ``, ErrQRCodeExpired
+			}
+			refreshed++
+
+			if uuid, err = wechat.fetchUUID(); err != nil {
+				return ``, err
+			}
+			if err = wechat.conf.Processor.ProcessUUID(uuid, wechat.conf.Storage); err != nil {
+				return ``, err
+			}
+			if observer != nil {
+				observer.Refreshed(uuid)
+			}
+			wechat.emit(`Login`, `Wechat`, `/qrlogin/refreshed`, EventLoginData{UUID: uuid})
+
+			tip, scanned = 1, false
+		}
+	}
+}
+
+func (wechat *WeChat) waitConfirmUUID(uuid string, tip int) (redirectURI, code string, avatar []byte, rt int, err error) {
+
+	apiURL, rt := fmt.Sprintf("https://login.weixin.qq.com/cgi-bin/mmwebwx-bin/login?tip=%d&uuid=%s&_=%s", tip, uuid, strconv.FormatInt(time.Now().Unix(), 10)), tip
+	resp, err := wechat.Client.Get(apiURL)
 	if err != nil {
 		return
 	}
@@ -226,15 +402,17 @@ func (wechat *WeChat) waitConfirmUUID(uuid string, tip int) (redirectURI, code s
 	rt = 0
 	switch code {
 	case "201":
-		log.Debug(`扫描成功，等待微信发送确认请求...`)
+		wechat.log.Debug(`扫描成功，等待微信发送确认请求...`)
+		// window.userAvatar = 'data:img/jpg;base64,...';
+		if encoded, e := search(ds, `base64,`, `'`); e == nil {
+			avatar, _ = base64.StdEncoding.DecodeString(encoded)
+		}
 	case httpOK:
 		redirectURI, err = search(ds, `window.redirect_uri="`, `";`)
 		if err != nil {
 			return
 		}
 		redirectURI += "&fun=new"
-	default:
-		err = fmt.Errorf("连接超时, 准备重新连接 %v...", err)
 	}
 	return
 }
@@ -252,13 +430,16 @@ func (wechat *WeChat) login(req *http.Request) error {
 
 	// full fill base request
 	if err = xml.NewDecoder(reader).Decode(wechat.BaseRequest); err != nil {
-		log.Error(err.Error())
+		wechat.log.Error(err.Error())
 		return err
 	}
 
 	if wechat.BaseRequest.Ret != 0 { // 0 is success
-		err = fmt.Errorf("login failed message:[%s]", wechat.BaseRequest.Message)
-		return err
+		return &APIError{
+			Ret:      wechat.BaseRequest.Ret,
+			ErrMsg:   wechat.BaseRequest.Message,
+			Endpoint: endpoint(req.URL),
+		}
 	}
 
 	//5.
@@ -302,45 +483,61 @@ func (wechat *WeChat) init() error {
 	wechat.MySelf = resp.User
 	wechat.syncKey = resp.SyncKey
 
+	wechat.log.setFields(`uin`, wechat.BaseRequest.Wxuin, `nickname`, wechat.MySelf.NickName)
+
 	return nil
 }
 
 func (wechat *WeChat) keepAlive() {
 	go func() {
 
-		err := wechat.reLogin()
-
-		if err != nil {
-			log.Errorf(`登陆失败: %v ...`, err)
-			retryTimes := wechat.retryTimes
-			triggerAfter := time.After(time.Minute * retryTimes)
-			log.Warnf(`准备 %d 分钟后重新登陆...`, retryTimes)
-			<-triggerAfter
-			wechat.retryTimes++
-			wechat.keepAlive()
-			return
+		policy := wechat.reconnectPolicy()
+		attempt := 0
+
+		for {
+			err := wechat.reLogin()
+
+			if err != nil {
+				attempt++
+				wechat.log.Errorf(`登陆失败: %v ...`, err)
+
+				if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+					wechat.log.Errorf(`连续 %d 次登陆失败，放弃重新登陆 ...`, attempt)
+					wechat.notifyLoginState(-1)
+					if policy.OnGiveUp != nil {
+						policy.OnGiveUp(err)
+					}
+					return
+				}
+
+				delay := policy.Delay(attempt)
+				wechat.log.Warnf(`准备 %v 后第 %d 次重新登陆...`, delay, attempt)
+				wechat.emit(`Login`, `Wechat`, `/reconnect/retry`, EventRetryData{Attempt: attempt, Delay: delay, Err: err})
+				time.Sleep(delay)
+				continue
+			}
+
+			attempt = 0
+
+			wechat.log.Trac(`微信登陆成功... ...`)
+
+			wechat.log.Trac(`开始同步联系人...`)
+			err = wechat.SyncContact()
+			if err != nil {
+				wechat.log.Errorf(`同步联系人失败: %v`, err)
+			}
+			wechat.log.Info(`同步联系人成功...`)
+
+			wechat.IsLogin = true
+			wechat.health.setLogin(true)
+			wechat.notifyLoginState(1)
+			err = wechat.beginSync()
+			wechat.IsLogin = false
+			wechat.health.setLogin(false)
+			wechat.notifyLoginState(-1)
+
+			wechat.log.Errorf(`同步失败: %v...`, err)
 		}
-
-		log.Trac(`微信登陆成功... ...`)
-
-		log.Trac(`开始同步联系人...`)
-		err = wechat.SyncContact()
-		if err != nil {
-			log.Errorf(`同步联系人失败: %v`, err)
-		}
-		log.Info(`同步联系人成功...`)
-
-        wechat.IsLogin = true
-		wechat.loginState <- 1
-		err = wechat.beginSync()
-        wechat.IsLogin = false
-		wechat.loginState <- -1
-
-		log.Errorf(`同步失败: %v...`, err)
-
-		wechat.keepAlive() // if listen occured error will excute this cmd.
-
-		return
 	}()
 }
 
@@ -376,10 +573,10 @@ func (wechat *WeChat) refreshCookieCache(cookies []*http.Cookie) {
 	}
 	b, err := json.Marshal(cookies)
 	if err != nil {
-		log.Warnf(`刷新 cookie 失败: %v...`, err)
+		wechat.log.Warnf(`刷新 cookie 失败: %v...`, err)
 	} else {
-		createFile(wechat.conf.cookieCachePath(), b, false)
-		log.Info(`刷新 cookie 缓存...`)
+		wechat.saveFile(wechat.conf.cookieCachePath(), b, false)
+		wechat.log.Info(`刷新 cookie 缓存...`)
 	}
 }
 
@@ -400,7 +597,17 @@ func (wechat *WeChat) refreshBaseInfo() {
 	info[`baseURL`] = wechat.BaseURL
 	info[`passTicket`] = wechat.BaseRequest.PassTicket
 	info[`baseRequest`] = wechat.BaseRequest
+	if len(wechat.syncHost) > 0 {
+		info[`syncHost`] = wechat.syncHost
+	}
+	if !wechat.syncKey.IsEmpty() {
+		info[`syncKey`] = wechat.syncKey
+	}
+	if t, id := wechat.lastMsg.get(); t > 0 {
+		info[`lastMsgTime`] = t
+		info[`lastMsgId`] = id
+	}
 
 	data, _ := json.Marshal(info)
-	createFile(wechat.conf.baseInfoCachePath(), data, false)
+	wechat.saveFile(wechat.conf.baseInfoCachePath(), data, false)
 }
@@ -0,0 +1,148 @@
+package webot
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MentionAll 用在 SendGroupText 中表示 @所有人，只有群主可以使用
+const MentionAll = `all`
+
+// 微信使用 U+2005 作为 @ 的结束符
+const mentionSeparator = "\u2005"
+
+var mentionTemplate = regexp.MustCompile(`\{\{@([^{}]+)\}\}`)
+
+// SendGroupText 发送群消息并 @ mentions (群成员 GGID) 中的成员
+// text 中可以使用 {{@ggid}} 指定 @ 出现的位置，{{@all}} 表示 @所有人，没有出现在 text 中的 mention 会放在消息开头
+func (wechat *WeChat) SendGroupText(group, text string, mentions ...string) error {
+
+	g, err := wechat.cache.contactByUserName(group)
+	if err != nil {
+		return err
+	}
+
+	var resolveErr error
+	used := make(map[string]bool)
+
+	// 只转换 text 中的表情，@ 的群昵称原样发送
+	content := mentionTemplate.ReplaceAllStringFunc(wechat.encodeText(text), func(tpl string) string {
+		id := mentionTemplate.FindStringSubmatch(tpl)[1]
+		at, err := wechat.mentionText(g, id)
+		if err != nil {
+			resolveErr = err
+			return tpl
+		}
+		used[id] = true
+		return at
+	})
+	if resolveErr != nil {
+		return resolveErr
+	}
+
+	prefix := ``
+	for _, id := range mentions {
+		if used[id] {
+			continue
+		}
+		at, err := wechat.mentionText(g, id)
+		if err != nil {
+			return err
+		}
+		used[id] = true
+		prefix += at
+	}
+
+	return wechat.sendText(prefix+content, group)
+}
+
+// mentionText 返回 `@群昵称 `
+func (wechat *WeChat) mentionText(group *Contact, id string) (string, error) {
+
+	if id == MentionAll {
+		if group.IsOwner != 1 && group.ChatRoomOwner != wechat.MySelf.UserName {
+			return ``, errors.New(`only group owner can mention all`)
+		}
+		return `@所有人` + mentionSeparator, nil
+	}
+
+	for _, m := range group.MemberList {
+		if m.GGID == id || m.UserName == id {
+			return `@` + memberDisplayName(m) + mentionSeparator, nil
+		}
+	}
+
+	// 群成员的 GGID 可能没有同步，用联系人的 UserName 再找一次
+	if c, err := wechat.cache.contactByGGID(id); err == nil {
+		for _, m := range group.MemberList {
+			if m.UserName == c.UserName {
+				return `@` + memberDisplayName(m) + mentionSeparator, nil
+			}
+		}
+	}
+
+	return ``, fmt.Errorf(`%w: [%s] is not a member of group [%s]`, ErrContactNotFound, id, group.NickName)
+}
+
+func memberDisplayName(m *Contact) string {
+	if len(m.DisplayName) > 0 {
+		return m.DisplayName
+	}
+	return m.NickName
+}
+
+// mentionAllMember 代表 @所有人
+var mentionAllMember = &Contact{NickName: `所有人`}
+
+// parseMentions 解析 content 中所有的 `@群昵称 `，返回被 @ 的群成员和去掉 @ 以后的内容
+func parseMentions(group *Contact, content string) ([]*Contact, string) {
+
+	var members []*Contact
+	var stripped strings.Builder
+
+	for i := 0; i < len(content); {
+
+		if content[i] != '@' {
+			stripped.WriteByte(content[i])
+			i++
+			continue
+		}
+
+		rest := content[i+1:]
+		var found *Contact
+		length := 0
+
+		// 使用最长匹配，避免 `@张三` 被误认为 `@张`
+		match := func(m *Contact) {
+			for _, name := range []string{m.DisplayName, m.NickName} {
+				if len(name) <= length || !strings.HasPrefix(rest, name) {
+					continue
+				}
+				after := rest[len(name):]
+				if len(after) == 0 || strings.HasPrefix(after, mentionSeparator) {
+					found, length = m, len(name)
+				}
+			}
+		}
+		for _, m := range group.MemberList {
+			match(m)
+		}
+		match(mentionAllMember)
+
+		if found == nil {
+			stripped.WriteByte('@')
+			i++
+			continue
+		}
+
+		members = append(members, found)
+		i += 1 + length
+		if strings.HasPrefix(content[i:], mentionSeparator) {
+			i += len(mentionSeparator)
+		}
+	}
+
+	return members, strings.TrimSpace(stripped.String())
+}
@@ -0,0 +1,47 @@
+package webot
+
+import "testing"
+
+func TestParseMentions(t *testing.T) {
+
+	zhang := &Contact{UserName: `@zhang`, NickName: `张`}
+	zhangsan := &Contact{UserName: `@zhangsan`, NickName: `张三`}
+	wang := &Contact{UserName: `@wang`, NickName: `Wang`, DisplayName: `老王`}
+	bob := &Contact{UserName: `@bob`, NickName: `Bob`}
+
+	group := &Contact{MemberList: []*Contact{zhang, zhangsan, wang, bob}}
+
+	cases := []struct {
+		name     string
+		content  string
+		members  []*Contact
+		stripped string
+	}{
+		{`longest prefix`, "@张三\u2005你好", []*Contact{zhangsan}, `你好`},
+		{`shorter name`, "@张\u2005你好", []*Contact{zhang}, `你好`},
+		{`display name`, "@老王\u2005吃饭了吗", []*Contact{wang}, `吃饭了吗`},
+		{`at the end`, "hi @Bob", []*Contact{bob}, `hi`},
+		{`several`, "@Bob\u2005@张三\u2005开会", []*Contact{bob, zhangsan}, `开会`},
+		{`without separator`, `@Bobby hi`, nil, `@Bobby hi`},
+		{`ascii space`, `@Bob hi`, nil, `@Bob hi`},
+		{`unknown member`, "@nobody\u2005hi", nil, "@nobody\u2005hi"},
+		{`email`, `mail me at a@b.com`, nil, `mail me at a@b.com`},
+		{`mention all`, "@所有人\u2005开会", []*Contact{mentionAllMember}, `开会`},
+	}
+
+	for _, c := range cases {
+		members, stripped := parseMentions(group, c.content)
+		if stripped != c.stripped {
+			t.Errorf(`%s: stripped = %q, want %q`, c.name, stripped, c.stripped)
+		}
+		if len(members) != len(c.members) {
+			t.Errorf(`%s: got %d members, want %d`, c.name, len(members), len(c.members))
+			continue
+		}
+		for i := range members {
+			if members[i] != c.members[i] {
+				t.Errorf(`%s: members[%d] = %q, want %q`, c.name, i, members[i].NickName, c.members[i].NickName)
+			}
+		}
+	}
+}
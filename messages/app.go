@@ -0,0 +1,45 @@
+package messages
+
+import "fmt"
+
+// AppMsg is wechat appmsg, such as url link card or mini program card
+type AppMsg struct {
+	to      string
+	content string
+	desc    string
+}
+
+// Path is app msg's api path
+func (msg *AppMsg) Path() string {
+	return `webwxsendappmsg?fun=async&f=json`
+}
+
+// To destation
+func (msg *AppMsg) To() string {
+	return msg.to
+}
+
+// Content app msg's content
+func (msg *AppMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = 49
+	content[`Content`] = msg.content
+
+	return content
+}
+
+// NewLinkMsg construct a url link card
+func NewLinkMsg(title, desc, url, thumbURL, to string) *AppMsg {
+	content := fmt.Sprintf(`<appmsg appid="" sdkver="0"><title>%s</title><des>%s</des><action>view</action><type>5</type><content></content><url>%s</url><lowurl></lowurl><thumburl>%s</thumburl></appmsg>`, escape(title), escape(desc), escape(url), escape(thumbURL))
+	return &AppMsg{to, content, title}
+}
+
+// NewAppMsg re-send a received appmsg, content is the unescaped appmsg xml
+func NewAppMsg(content, to string) *AppMsg {
+	return &AppMsg{to, content, `APPMSG`}
+}
+
+func (msg *AppMsg) String() string {
+	return msg.desc
+}
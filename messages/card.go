@@ -0,0 +1,39 @@
+package messages
+
+import "fmt"
+
+// CardMsg is wechat name card msg
+type CardMsg struct {
+	to       string
+	userName string
+	nickName string
+}
+
+// Path is card msg's api path
+func (msg *CardMsg) Path() string {
+	return `webwxsendmsg`
+}
+
+// To destation
+func (msg *CardMsg) To() string {
+	return msg.to
+}
+
+// Content card msg's content
+func (msg *CardMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = 42
+	content[`Content`] = fmt.Sprintf(`<msg username="%s" nickname="%s"/>`, escape(msg.userName), escape(msg.nickName))
+
+	return content
+}
+
+// NewCardMsg share contact (userName) to another contact
+func NewCardMsg(userName, nickName, to string) *CardMsg {
+	return &CardMsg{to, userName, nickName}
+}
+
+func (msg *CardMsg) String() string {
+	return `CARD ` + msg.nickName
+}
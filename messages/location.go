@@ -0,0 +1,42 @@
+package messages
+
+import "fmt"
+
+// LocationMsg is wechat location msg
+type LocationMsg struct {
+	to    string
+	x     float64
+	y     float64
+	scale int
+	label string
+	poi   string
+}
+
+// Path is location msg's api path
+func (msg *LocationMsg) Path() string {
+	return `webwxsendmsg`
+}
+
+// To destation
+func (msg *LocationMsg) To() string {
+	return msg.to
+}
+
+// Content location msg's content
+func (msg *LocationMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = 48
+	content[`Content`] = fmt.Sprintf(`<msg><location x="%f" y="%f" scale="%d" label="%s" maptype="0" poiname="%s" /></msg>`, msg.x, msg.y, msg.scale, escape(msg.label), escape(msg.poi))
+
+	return content
+}
+
+// NewLocationMsg x is latitude, y is longitude
+func NewLocationMsg(x, y float64, scale int, label, poi, to string) *LocationMsg {
+	return &LocationMsg{to, x, y, scale, label, poi}
+}
+
+func (msg *LocationMsg) String() string {
+	return `LOCATION ` + msg.label
+}
@@ -0,0 +1,13 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+// escape make s safe to be interpolated into xml content or attribute
+func escape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
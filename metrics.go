@@ -0,0 +1,215 @@
+package webot
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 直方图的分桶，单位秒，synccheck 长轮询一般在 25 秒左右
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	counts []uint64 // 与 metricBuckets 一一对应，不累加
+	sum    float64
+	count  uint64
+}
+
+// metrics 简单的 Prometheus 文本格式指标，不依赖 client_golang
+type metrics struct {
+	sync.Mutex
+	help       map[string]string
+	counters   map[string]map[string]float64 // name => labels => value
+	histograms map[string]map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		help: map[string]string{
+			`webot_api_requests_total`:           `API requests by endpoint and ret code.`,
+			`webot_api_request_duration_seconds`: `API request latency by endpoint.`,
+			`webot_synccheck_duration_seconds`:   `Synccheck long-poll duration.`,
+			`webot_events_total`:                 `Events dispatched by path.`,
+			`webot_handler_duration_seconds`:     `Handler latency by pattern.`,
+			`webot_messages_received_total`:      `Messages received by MsgType.`,
+			`webot_messages_sent_total`:          `Messages sent by MsgType.`,
+			`webot_contacts`:                     `Contacts in the local cache.`,
+			`webot_event_queue_length`:           `Server events waiting to be dispatched.`,
+		},
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// Prometheus 文本格式的 label 值只需要转义 \ " 和换行
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels 按 key=value 成对传入
+func labels(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, kv[i]+`="`+labelEscaper.Replace(kv[i+1])+`"`)
+	}
+	return strings.Join(pairs, `,`)
+}
+
+func (m *metrics) inc(name, labels string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][labels]++
+}
+
+func (m *metrics) observe(name, labels string, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	h, found := m.histograms[name][labels]
+	if !found {
+		h = &histogram{counts: make([]uint64, len(metricBuckets))}
+		m.histograms[name][labels] = h
+	}
+	v := d.Seconds()
+	for i, le := range metricBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *metrics) observeRequest(endpoint, ret string, d time.Duration) {
+	m.inc(`webot_api_requests_total`, labels(`endpoint`, endpoint, `ret`, ret))
+	m.observe(`webot_api_request_duration_seconds`, labels(`endpoint`, endpoint), d)
+}
+
+func withLabel(ls, extra string) string {
+	if len(ls) == 0 {
+		return extra
+	}
+	return ls + `,` + extra
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snapshot 复制当前的指标，避免输出时持有锁
+func (m *metrics) snapshot() (map[string]map[string]float64, map[string]map[string]histogram) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	counters := make(map[string]map[string]float64, len(m.counters))
+	for name, series := range m.counters {
+		counters[name] = make(map[string]float64, len(series))
+		for ls, v := range series {
+			counters[name][ls] = v
+		}
+	}
+
+	histograms := make(map[string]map[string]histogram, len(m.histograms))
+	for name, series := range m.histograms {
+		histograms[name] = make(map[string]histogram, len(series))
+		for ls, h := range series {
+			histograms[name][ls] = histogram{
+				counts: append([]uint64(nil), h.counts...),
+				sum:    h.sum,
+				count:  h.count,
+			}
+		}
+	}
+
+	return counters, histograms
+}
+
+// write 以文本格式输出，gauges 为抓取时才计算的指标
+func (m *metrics) write(w io.Writer, gauges map[string]float64) {
+
+	counters, histograms := m.snapshot()
+
+	header := func(name, kind string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, m.help[name], name, kind)
+	}
+	series := func(name, ls string, v float64) {
+		if len(ls) > 0 {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, ls, v)
+		} else {
+			fmt.Fprintf(w, "%s %v\n", name, v)
+		}
+	}
+
+	for _, name := range sortedKeys(gauges) {
+		header(name, `gauge`)
+		series(name, ``, gauges[name])
+	}
+
+	counterNames := make([]string, 0, len(counters))
+	for name := range counters {
+		counterNames = append(counterNames, name)
+	}
+	sort.Strings(counterNames)
+	for _, name := range counterNames {
+		header(name, `counter`)
+		for _, ls := range sortedKeys(counters[name]) {
+			series(name, ls, counters[name][ls])
+		}
+	}
+
+	histogramNames := make([]string, 0, len(histograms))
+	for name := range histograms {
+		histogramNames = append(histogramNames, name)
+	}
+	sort.Strings(histogramNames)
+	for _, name := range histogramNames {
+		header(name, `histogram`)
+		hs := histograms[name]
+		keys := make([]string, 0, len(hs))
+		for ls := range hs {
+			keys = append(keys, ls)
+		}
+		sort.Strings(keys)
+		for _, ls := range keys {
+			h := hs[ls]
+			cumulative := uint64(0)
+			for i, le := range metricBuckets {
+				cumulative += h.counts[i]
+				series(name+`_bucket`, withLabel(ls, fmt.Sprintf(`le="%v"`, le)), float64(cumulative))
+			}
+			series(name+`_bucket`, withLabel(ls, `le="+Inf"`), float64(h.count))
+			series(name+`_sum`, ls, h.sum)
+			series(name+`_count`, ls, float64(h.count))
+		}
+	}
+}
+
+// MetricsHandler 以 Prometheus 文本格式输出指标，可以挂载到 /metrics
+func (wechat *WeChat) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		wechat.cache.Lock()
+		contacts := len(wechat.cache.ggmap)
+		wechat.cache.Unlock()
+
+		w.Header().Set(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+		wechat.metrics.write(w, map[string]float64{
+			`webot_contacts`:           float64(contacts),
+			`webot_event_queue_length`: float64(len(wechat.evtStream.serverEvt)),
+		})
+	})
+}
@@ -5,13 +5,14 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
-	"mime/multipart"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -42,11 +43,17 @@ type Msg interface {
 
 var mediaIndex = int64(0)
 
+// SendFromURL 下载文件的大小上限
+const maxURLFileSize = 100 << 20
+
+// urlClient SendFromURL 使用的 client，校验证书并且不带登录的 cookie
+var urlClient = &http.Client{Timeout: 5 * time.Minute}
+
 // SendMsg is desined to send Message to group or contact
 func (wechat *WeChat) SendMsg(message Msg) error {
 
-	if wechat.BaseRequest == nil {
-		return fmt.Errorf(`wechat BaseRequest is empty`)
+	if !wechat.IsLogin || wechat.BaseRequest == nil || len(wechat.BaseRequest.Skey) == 0 {
+		return ErrNotLoggedIn
 	}
 
 	msg := baseMsg(message.To())
@@ -70,7 +77,7 @@ func (wechat *WeChat) SendMsg(message Msg) error {
 		return err
 	}
 
-	//log.Debugf(`发送消息: [%s]...`, msg[`LocalID`])
+	//wechat.log.Debugf(`发送消息: [%s]...`, msg[`LocalID`])
 
 	resp := new(sendMsgResponse)
 
@@ -85,14 +92,23 @@ func (wechat *WeChat) SendMsg(message Msg) error {
 	err = wechat.Excute(apiURL, buffer, resp)
 
 	if err != nil {
-		log.Debugf(`消息发送失败：%s`, err)
+		wechat.log.Debugf(`消息发送失败：%s`, err)
+		return err
 	}
 
-	return err
+	wechat.health.mark(&wechat.health.lastMsgSent)
+	wechat.metrics.inc(`webot_messages_sent_total`, labels(`type`, fmt.Sprint(msg[`Type`])))
+
+	return nil
 }
 
 // SendTextMsg send text message
 func (wechat *WeChat) SendTextMsg(msg, to string) error {
+	return wechat.sendText(wechat.encodeText(msg), to)
+}
+
+// sendText 原样发送 msg，不转换表情
+func (wechat *WeChat) sendText(msg, to string) error {
 	textMsg := messages.NewTextMsg(msg, to)
 	return wechat.SendMsg(textMsg)
 }
@@ -100,7 +116,12 @@ func (wechat *WeChat) SendTextMsg(msg, to string) error {
 // SendFile is desined to send contain attachment Message to group or contact.
 // path must exit in local file system.
 func (wechat *WeChat) SendFile(path, to string) error {
-	msg, err := wechat.newMsg(path, to)
+	return wechat.SendFileWithProgress(path, to, nil)
+}
+
+// SendFileWithProgress same as SendFile, progress is called after every uploaded chunk.
+func (wechat *WeChat) SendFileWithProgress(path, to string, progress func(sent, total int64)) error {
+	msg, err := wechat.newMsg(path, to, progress)
 	if err != nil {
 		return err
 	}
@@ -108,175 +129,173 @@ func (wechat *WeChat) SendFile(path, to string) error {
 	return wechat.SendMsg(msg)
 }
 
-// UploadMedia is a convernice method to upload attachment to wx cdn.
-func (wechat *WeChat) UploadMedia(buf []byte, kind types.Type, info os.FileInfo, to string) (string, error) {
+// SendImage send image read from r, gif will be sent as emoticon.
+func (wechat *WeChat) SendImage(r io.Reader, name, to string) error {
+	return wechat.sendReader(r, name, to, filetype.IsImage)
+}
 
-	// Only the first 261 bytes are used to sniff the content type.
-	head := buf[:261]
+// SendVideo send video read from r.
+func (wechat *WeChat) SendVideo(r io.Reader, name, to string) error {
+	return wechat.sendReader(r, name, to, filetype.IsVideo)
+}
 
-	var mediatype string
-	if filetype.IsImage(head) {
-		mediatype = `pic`
-	} else if filetype.IsVideo(head) {
-		mediatype = `video`
-	} else {
-		mediatype = `doc`
-	}
+// SendFileBytes send data in memory, message type is decided by the content.
+func (wechat *WeChat) SendFileBytes(data []byte, name, to string) error {
+	return wechat.sendReader(bytes.NewReader(data), name, to, nil)
+}
 
-	fields := map[string]string{
-		`id`:                `WU_FILE_` + str(mediaIndex),
-		`name`:              info.Name(),
-		`type`:              kind.MIME.Value,
-		`lastModifiedDate`:  info.ModTime().UTC().String(),
-		`size`:              str(info.Size()),
-		`mediatype`:         mediatype,
-		`pass_ticket`:       wechat.BaseRequest.PassTicket,
-		`webwx_data_ticket`: wechat.CookieDataTicket(),
-	}
-
-	media, err := json.Marshal(&map[string]interface{}{
-		`BaseRequest`:   wechat.BaseRequest,
-		`ClientMediaId`: now(),
-		`TotalLen`:      str(info.Size()),
-		`StartPos`:      0,
-		`DataLen`:       str(info.Size()),
-		`MediaType`:     4,
-		`UploadType`:    2,
-		`ToUserName`:    to,
-		`FromUserName`:  wechat.MySelf.UserName,
-		`FileMd5`:       string(md5.New().Sum(buf)),
-	})
+// SendFromURL download the resource of url (at most 100MB) and send it.
+func (wechat *WeChat) SendFromURL(rawURL, to string) error {
 
+	resp, err := urlClient.Get(rawURL)
 	if err != nil {
-		return ``, err
+		return err
 	}
+	defer resp.Body.Close()
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	fw, err := writer.CreateFormFile(`filename`, info.Name())
-	if err != nil {
-		return ``, err
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(`download [%s] failed: %s`, rawURL, resp.Status)
 	}
-	fw.Write(buf)
-
-	for k, v := range fields {
-		writer.WriteField(k, v)
+	if resp.ContentLength > maxURLFileSize {
+		return fmt.Errorf(`download [%s] failed: file larger than %d bytes`, rawURL, maxURLFileSize)
 	}
 
-	writer.WriteField(`uploadmediarequest`, string(media))
-	writer.Close()
-
-	urlOBJ, err := url.Parse(wechat.BaseURL)
-
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxURLFileSize+1))
 	if err != nil {
-		return ``, err
+		return err
 	}
-
-	host := urlOBJ.Host
-
-	urls := [2]string{
-		fmt.Sprintf(`https://file.%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json`, host),
-		fmt.Sprintf(`https://file2.%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json`, host),
+	if len(data) > maxURLFileSize {
+		return fmt.Errorf(`download [%s] failed: file larger than %d bytes`, rawURL, maxURLFileSize)
 	}
 
-	for _, url := range urls {
-
-		var req *http.Request
-		req, err = http.NewRequest(`POST`, url, body)
-		if err != nil {
-			return ``, err
-		}
-
-		req.Header.Set(`Content-Type`, writer.FormDataContentType())
-
-		resp := new(uploadMediaResponse)
-
-		err = wechat.ExcuteRequest(req, resp)
-		if err != nil {
-			return ``, err
+	name := ``
+	if _, params, e := mime.ParseMediaType(resp.Header.Get(`Content-Disposition`)); e == nil {
+		name = params[`filename`]
+	}
+	if len(name) == 0 {
+		if u, e := url.Parse(rawURL); e == nil {
+			name = path.Base(u.Path)
 		}
-
-		mediaIndex++
-		return resp.MediaID, nil
+	}
+	if len(name) == 0 || name == `/` || name == `.` {
+		name = `file`
 	}
 
-	return ``, err
+	return wechat.sendReader(bytes.NewReader(data), name, to, nil)
 }
 
-// DownloadMedia use to download a voice or immage msg
-func (wechat *WeChat) DownloadMedia(url string, localPath string) (string, error) {
+// sendReader upload content of r without temp file, is checks the sniffed head if not nil.
+func (wechat *WeChat) sendReader(r io.Reader, name, to string, is func([]byte) bool) error {
 
-	req, err := http.NewRequest(`GET`, url, nil)
-	if err != nil {
-		return ``, err
+	hash := md5.New()
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, io.TeeReader(r, hash)); err != nil {
+		return err
 	}
+	data := buf.Bytes()
 
-	req.Header.Set(`Range`, `bytes=0-`) // 只有小视频才需要加这个headers
-
-	resp, err := wechat.Client.Do(req)
-	defer resp.Body.Close()
-
-	if err != nil {
-		return ``, err
+	head := data
+	if len(head) > 261 {
+		head = head[:261]
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ``, err
+	kind, _ := filetype.Match(head)
+
+	if is != nil && !is(head) {
+		return fmt.Errorf(`unexpected content type [%s] of [%s]`, kind.MIME.Value, name)
 	}
 
-	t, err := filetype.Get(data)
-	if err != nil {
-		return ``, err
+	if len(path.Ext(name)) == 0 && len(kind.Extension) > 0 {
+		name += `.` + kind.Extension
 	}
 
-	path := filepath.Join(wechat.conf.Storage,"image",localPath + `.` + t.Extension)
-	err = createFile(path, data, false)
+	media, err := wechat.UploadStream(bytes.NewReader(data), UploadOptions{
+		Name: name,
+		Size: int64(len(data)),
+		MIME: kind.MIME.Value,
+		MD5:  fmt.Sprintf(`%x`, hash.Sum(nil)),
+		To:   to,
+	})
 	if err != nil {
-		return ``, err
+		return err
 	}
 
-	return path, nil
+	return wechat.SendMsg(mediaMsg(media, to, head, kind, name, int64(len(data))))
+}
+
+// UploadMedia is a convernice method to upload attachment to wx cdn.
+func (wechat *WeChat) UploadMedia(buf []byte, kind types.Type, info os.FileInfo, to string) (string, error) {
+	return wechat.UploadStream(bytes.NewReader(buf), UploadOptions{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		MIME:    kind.MIME.Value,
+		ModTime: info.ModTime(),
+		MD5:     fmt.Sprintf(`%x`, md5.Sum(buf)),
+		To:      to,
+	})
 }
 
 // NewMsg create new message instance
-func (wechat *WeChat) newMsg(filepath, to string) (Msg, error) {
+func (wechat *WeChat) newMsg(filepath, to string, progress func(sent, total int64)) (Msg, error) {
 
-	info, err := os.Stat(filepath)
+	file, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	buf, err := ioutil.ReadFile(filepath)
+	info, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
-	kind, _ := filetype.Get(buf)
 
-	media, err := wechat.UploadMedia(buf, kind, info, to)
+	head := make([]byte, 261)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	kind, _ := filetype.Match(head)
+
+	hash := md5.New()
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
 
+	media, err := wechat.UploadStream(file, UploadOptions{
+		Name:     info.Name(),
+		Size:     info.Size(),
+		MIME:     kind.MIME.Value,
+		ModTime:  info.ModTime(),
+		MD5:      fmt.Sprintf(`%x`, hash.Sum(nil)),
+		To:       to,
+		Progress: progress,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var msg Msg
+	return mediaMsg(media, to, head, kind, info.Name(), info.Size()), nil
+}
+
+// mediaMsg choose message type by the sniffed head of attachment.
+func mediaMsg(media, to string, head []byte, kind types.Type, name string, size int64) Msg {
 
-	if filetype.IsImage(buf) {
+	if filetype.IsImage(head) {
 		if strings.HasSuffix(kind.MIME.Value, `gif`) {
-			msg = messages.NewEmoticonMsgMsg(media, to)
-		} else {
-			msg = messages.NewImageMsg(media, to)
-		}
-	} else {
-		info, _ := os.Stat(filepath)
-		if filetype.IsVideo(buf) {
-			msg = messages.NewVideoMsg(media, to)
-		} else {
-			msg = messages.NewFileMsg(media, to, info.Name(), kind.Extension)
+			return messages.NewEmoticonMsgMsg(media, to)
 		}
+		return messages.NewImageMsg(media, to)
 	}
-
-	return msg, err
+	if filetype.IsVideo(head) {
+		return messages.NewVideoMsg(media, to)
+	}
+	return messages.NewFileMsgWithSize(media, to, name, kind.Extension, size)
 }
 
 func clientMsgID() string {
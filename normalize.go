@@ -0,0 +1,206 @@
+package webot
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	emojiSpan = regexp.MustCompile(`<span class=\\?"emoji emoji([a-fA-F0-9]+)\\?"></span>`)
+	brTag     = regexp.MustCompile(`(?i)<br\s*/?>`)
+	wxEmoji   = regexp.MustCompile(`\[[^\[\]]{1,4}\]`)
+)
+
+// 微信自带表情和 Unicode emoji 的对应关系，发送时反向转换
+var wxEmojiTable = [][2]string{
+	{`[微笑]`, "\U0001F642"},
+	{`[撇嘴]`, "\U0001F612"},
+	{`[色]`, "\U0001F60D"},
+	{`[发呆]`, "\U0001F633"},
+	{`[得意]`, "\U0001F60E"},
+	{`[流泪]`, "\U0001F622"},
+	{`[害羞]`, "\U0001F60A"},
+	{`[闭嘴]`, "\U0001F910"},
+	{`[睡]`, "\U0001F634"},
+	{`[大哭]`, "\U0001F62D"},
+	{`[尴尬]`, "\U0001F605"},
+	{`[发怒]`, "\U0001F621"},
+	{`[调皮]`, "\U0001F61C"},
+	{`[呲牙]`, "\U0001F601"},
+	{`[惊讶]`, "\U0001F632"},
+	{`[难过]`, "\U0001F641"},
+	{`[抓狂]`, "\U0001F62B"},
+	{`[吐]`, "\U0001F92E"},
+	{`[偷笑]`, "\U0001F92D"},
+	{`[愉快]`, "\U0001F604"},
+	{`[白眼]`, "\U0001F644"},
+	{`[傲慢]`, "\U0001F624"},
+	{`[困]`, "\U0001F62A"},
+	{`[惊恐]`, "\U0001F631"},
+	{`[憨笑]`, "\U0001F606"},
+	{`[悠闲]`, "\U0001F60C"},
+	{`[咒骂]`, "\U0001F92C"},
+	{`[疑问]`, "❓"},
+	{`[嘘]`, "\U0001F92B"},
+	{`[晕]`, "\U0001F635"},
+	{`[骷髅]`, "\U0001F480"},
+	{`[敲打]`, "\U0001F528"},
+	{`[再见]`, "\U0001F44B"},
+	{`[擦汗]`, "\U0001F625"},
+	{`[鼓掌]`, "\U0001F44F"},
+	{`[坏笑]`, "\U0001F60F"},
+	{`[哈欠]`, "\U0001F971"},
+	{`[委屈]`, "\U0001F97A"},
+	{`[阴险]`, "\U0001F608"},
+	{`[亲亲]`, "\U0001F618"},
+	{`[可怜]`, "\U0001F614"},
+	{`[笑脸]`, "\U0001F603"},
+	{`[生病]`, "\U0001F637"},
+	{`[破涕为笑]`, "\U0001F602"},
+	{`[恐惧]`, "\U0001F628"},
+	{`[失望]`, "\U0001F61E"},
+	{`[无语]`, "\U0001F636"},
+	{`[捂脸]`, "\U0001F926"},
+	{`[吃瓜]`, "\U0001F349"},
+	{`[加油]`, "\U0001F4AA"},
+	{`[汗]`, "\U0001F613"},
+	{`[天啊]`, "\U0001F62E"},
+	{`[Emm]`, "\U0001F914"},
+	{`[旺柴]`, "\U0001F436"},
+	{`[哇]`, "\U0001F929"},
+	{`[嘴唇]`, "\U0001F48B"},
+	{`[爱心]`, "❤"},
+	{`[心碎]`, "\U0001F494"},
+	{`[拥抱]`, "\U0001F917"},
+	{`[强]`, "\U0001F44D"},
+	{`[弱]`, "\U0001F44E"},
+	{`[握手]`, "\U0001F91D"},
+	{`[胜利]`, "✌"},
+	{`[抱拳]`, "\U0001F64F"},
+	{`[拳头]`, "\U0001F44A"},
+	{`[OK]`, "\U0001F44C"},
+	{`[啤酒]`, "\U0001F37A"},
+	{`[咖啡]`, "☕"},
+	{`[蛋糕]`, "\U0001F382"},
+	{`[玫瑰]`, "\U0001F339"},
+	{`[凋谢]`, "\U0001F940"},
+	{`[菜刀]`, "\U0001F52A"},
+	{`[炸弹]`, "\U0001F4A3"},
+	{`[便便]`, "\U0001F4A9"},
+	{`[月亮]`, "\U0001F319"},
+	{`[太阳]`, "☀"},
+	{`[庆祝]`, "\U0001F389"},
+	{`[礼物]`, "\U0001F381"},
+	{`[红包]`, "\U0001F9E7"},
+	{`[烟花]`, "\U0001F386"},
+	{`[爆竹]`, "\U0001F9E8"},
+	{`[猪头]`, "\U0001F437"},
+}
+
+var (
+	wxEmojiDecoder = make(map[string]string, len(wxEmojiTable))
+	wxEmojiEncoder *strings.Replacer
+)
+
+func init() {
+	var pairs []string
+	for _, e := range wxEmojiTable {
+		wxEmojiDecoder[e[0]] = e[1]
+		// 带 U+FE0F 的写法放在前面，避免转换以后留下多余的变体选择符
+		pairs = append(pairs, e[1]+"\uFE0F", e[0], e[1], e[0])
+	}
+	wxEmojiEncoder = strings.NewReplacer(pairs...)
+}
+
+// decodeEmojiHex 将 1f604 / 1f1e81f1f3 / 2600fe0f / d83dde04 这样的编码转换成 Unicode
+func decodeEmojiHex(code string) (string, bool) {
+
+	var runes []rune
+	var surrogate rune
+
+	for len(code) > 0 {
+		n := 4
+		if len(code) >= 5 && strings.HasPrefix(strings.ToLower(code), `1f`) {
+			n = 5
+		}
+		if len(code) < n {
+			return ``, false
+		}
+		v, err := strconv.ParseUint(code[:n], 16, 32)
+		if err != nil {
+			return ``, false
+		}
+		code = code[n:]
+
+		r := rune(v)
+		switch {
+		case utf16.IsSurrogate(r) && surrogate == 0:
+			surrogate = r
+		case utf16.IsSurrogate(r):
+			runes = append(runes, utf16.DecodeRune(surrogate, r))
+			surrogate = 0
+		default:
+			runes = append(runes, r)
+		}
+	}
+
+	if surrogate != 0 || len(runes) == 0 {
+		return ``, false
+	}
+
+	return string(runes), true
+}
+
+// normalizeContent 把网页版微信返回的内容转换为普通文本:
+// emoji span => Unicode, <br/> => \n, HTML 实体解码, [微笑] => Unicode
+func normalizeContent(s string) string {
+
+	if strings.Contains(s, `emoji`) {
+		s = emojiSpan.ReplaceAllStringFunc(s, func(span string) string {
+			if emoji, ok := decodeEmojiHex(emojiSpan.FindStringSubmatch(span)[1]); ok {
+				return emoji
+			}
+			return span
+		})
+	}
+
+	s = brTag.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(s)
+
+	if strings.Contains(s, `[`) {
+		s = wxEmoji.ReplaceAllStringFunc(s, func(code string) string {
+			if emoji, found := wxEmojiDecoder[code]; found {
+				return emoji
+			}
+			return code
+		})
+	}
+
+	return s
+}
+
+// encodeContent normalizeContent 的反向转换，发送前把 Unicode 转换回微信自带表情
+func encodeContent(s string) string {
+	return wxEmojiEncoder.Replace(s)
+}
+
+// encodeText 只有设置了 Configure.EncodeEmoji 才转换表情
+func (wechat *WeChat) encodeText(s string) string {
+	if !wechat.conf.EncodeEmoji {
+		return s
+	}
+	return encodeContent(s)
+}
+
+// normalize 规范化联系人以及群成员的昵称、群昵称和备注
+func (contact *Contact) normalize() {
+	contact.NickName = normalizeContent(contact.NickName)
+	contact.DisplayName = normalizeContent(contact.DisplayName)
+	contact.RemarkName = normalizeContent(contact.RemarkName)
+	for _, m := range contact.MemberList {
+		m.normalize()
+	}
+}
@@ -0,0 +1,82 @@
+package webot
+
+import "testing"
+
+func TestDecodeEmojiHex(t *testing.T) {
+
+	cases := []struct {
+		code  string
+		emoji string
+		ok    bool
+	}{
+		{`1f604`, "\U0001F604", true},
+		{`1F604`, "\U0001F604", true},
+		{`1f1e81f1f3`, "\U0001F1E8\U0001F1F3", true},
+		{`2600fe0f`, "☀\uFE0F", true},
+		{`d83dde04`, "\U0001F604", true},
+		{`d83d`, ``, false},
+		{`1f6`, ``, false},
+		{`zzzz`, ``, false},
+		{``, ``, false},
+	}
+
+	for _, c := range cases {
+		emoji, ok := decodeEmojiHex(c.code)
+		if ok != c.ok || emoji != c.emoji {
+			t.Errorf(`decodeEmojiHex(%q) = %q, %v, want %q, %v`, c.code, emoji, ok, c.emoji, c.ok)
+		}
+	}
+}
+
+func TestNormalizeContent(t *testing.T) {
+
+	cases := []struct {
+		in, out string
+	}{
+		{`hi <span class="emoji emoji1f604"></span>`, "hi \U0001F604"},
+		{`<span class=\"emoji emoji1f604\"></span>`, "\U0001F604"},
+		{`<span class="emoji emojid83dde04"></span>`, "\U0001F604"},
+		{`<span class="emoji emoji1f1e81f1f3"></span>`, "\U0001F1E8\U0001F1F3"},
+		{`<span class="emoji emoji1f6"></span>`, `<span class="emoji emoji1f6"></span>`},
+		{`a<br/>b<BR>c<br />d`, "a\nb\nc\nd"},
+		{`&lt;b&gt; &amp; &quot;x&quot; &#39;`, `<b> & "x" '`},
+		{`[微笑][破涕为笑]`, "\U0001F642\U0001F602"},
+		{`[未知][微笑`, `[未知][微笑`},
+		{`plain text`, `plain text`},
+	}
+
+	for _, c := range cases {
+		if out := normalizeContent(c.in); out != c.out {
+			t.Errorf(`normalizeContent(%q) = %q, want %q`, c.in, out, c.out)
+		}
+	}
+}
+
+func TestEncodeContent(t *testing.T) {
+
+	cases := []struct {
+		in, out string
+	}{
+		{"\U0001F642", `[微笑]`},
+		{"I ❤\uFE0F you", `I [爱心] you`},
+		{"❤", `[爱心]`},
+		{"☀\uFE0F✌", `[太阳][胜利]`},
+		{`[微笑] hello`, `[微笑] hello`},
+	}
+
+	for _, c := range cases {
+		if out := encodeContent(c.in); out != c.out {
+			t.Errorf(`encodeContent(%q) = %q, want %q`, c.in, out, c.out)
+		}
+	}
+
+	// 没有设置 EncodeEmoji 时原样发送
+	wechat := &WeChat{conf: &Configure{}}
+	if out := wechat.encodeText("\U0001F642 ❤\uFE0F"); out != "\U0001F642 ❤\uFE0F" {
+		t.Errorf(`encodeText without EncodeEmoji = %q`, out)
+	}
+	wechat.conf.EncodeEmoji = true
+	if out := wechat.encodeText("\U0001F642"); out != `[微笑]` {
+		t.Errorf(`encodeText with EncodeEmoji = %q`, out)
+	}
+}
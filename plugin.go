@@ -0,0 +1,305 @@
+package webot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Plugin 可复用的机器人功能，例如自动回复、关键字提醒、入群欢迎
+type Plugin interface {
+	// Name 插件唯一名称，同时也是配置和存储的命名空间
+	Name() string
+	// Init 注册插件时调用
+	Init(bot PluginBot) error
+	// Routes 需要处理的事件路径，规则同 Handle
+	Routes() map[string]func(Event) error
+	// Commands 需要处理的文本命令，key 为不带前缀的命令名
+	Commands() map[string]func(Command) error
+	// Shutdown 机器人停止时调用
+	Shutdown() error
+}
+
+// PluginBot 插件能够使用的机器人能力
+type PluginBot interface {
+	SendMsg(message Msg) error
+	SendTextMsg(msg, to string) error
+	SendFile(path, to string) error
+	ContactByUserName(un string) (*Contact, error)
+	ContactByGGID(id string) (*Contact, error)
+	MembersOfGroup(groupUserName string) ([]*Contact, error)
+	// Emit 发送一个自定义事件
+	Emit(path string, data interface{})
+	// Config 插件在 Configure.Plugins 中的配置
+	Config() map[string]interface{}
+	// StoragePath 插件独占的存储目录
+	StoragePath() string
+}
+
+// Command 文本命令, 例如 `/weather 北京`
+type Command struct {
+	Name string
+	Args []string
+	Msg  EventMsgData
+}
+
+type pluginBot struct {
+	wechat *WeChat
+	name   string
+}
+
+func (pb *pluginBot) SendMsg(message Msg) error {
+	return pb.wechat.SendMsg(message)
+}
+
+func (pb *pluginBot) SendTextMsg(msg, to string) error {
+	return pb.wechat.SendTextMsg(msg, to)
+}
+
+func (pb *pluginBot) SendFile(path, to string) error {
+	return pb.wechat.SendFile(path, to)
+}
+
+func (pb *pluginBot) ContactByUserName(un string) (*Contact, error) {
+	return pb.wechat.ContactByUserName(un)
+}
+
+func (pb *pluginBot) ContactByGGID(id string) (*Contact, error) {
+	return pb.wechat.ContactByGGID(id)
+}
+
+func (pb *pluginBot) MembersOfGroup(groupUserName string) ([]*Contact, error) {
+	return pb.wechat.MembersOfGroup(groupUserName)
+}
+
+func (pb *pluginBot) Emit(path string, data interface{}) {
+	pb.wechat.emit(`Plugin`, pb.name, cleanPath(path), data)
+}
+
+func (pb *pluginBot) Config() map[string]interface{} {
+	if conf, found := pb.wechat.conf.Plugins[pb.name]; found {
+		return conf
+	}
+	return make(map[string]interface{})
+}
+
+func (pb *pluginBot) StoragePath() string {
+	return filepath.Join(pb.wechat.conf.Storage, `plugins`, pb.name)
+}
+
+type pluginEntry struct {
+	plugin   Plugin
+	routes   map[string]func(Event) error
+	commands map[string]func(Command) error
+	disabled bool
+	chats    map[string]bool // 单独设置的会话 GGID，true 启用 false 禁用，优先于全局设置
+}
+
+// enabledIn 插件在 chat 中是否启用，chat 为空时只看全局设置
+func (e *pluginEntry) enabledIn(chat string) bool {
+	if enabled, found := e.chats[chat]; found && len(chat) > 0 {
+		return enabled
+	}
+	return !e.disabled
+}
+
+type pluginManager struct {
+	sync.RWMutex
+	entries []*pluginEntry
+}
+
+func newPluginManager() *pluginManager {
+	return &pluginManager{}
+}
+
+func (pm *pluginManager) entry(name string) *pluginEntry {
+	for _, e := range pm.entries {
+		if e.plugin.Name() == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// RegisterPlugin 注册并初始化插件
+func (wechat *WeChat) RegisterPlugin(p Plugin) error {
+
+	pm := wechat.plugins
+	name := p.Name()
+
+	if len(name) == 0 {
+		return errors.New(`plugin name is empty`)
+	}
+
+	pm.RLock()
+	exist := pm.entry(name) != nil
+	pm.RUnlock()
+	if exist {
+		return fmt.Errorf(`plugin [%s] already registered`, name)
+	}
+
+	bot := &pluginBot{wechat, name}
+	if err := os.MkdirAll(bot.StoragePath(), os.ModePerm); err != nil {
+		return err
+	}
+
+	// 插件代码不能在持有锁的时候调用，Init 里可能会调用 EnablePlugin 等方法
+	if err := p.Init(bot); err != nil {
+		return err
+	}
+
+	routes := make(map[string]func(Event) error)
+	for path, handler := range p.Routes() {
+		routes[cleanPath(path)] = handler
+	}
+	commands := p.Commands()
+
+	pm.Lock()
+	defer pm.Unlock()
+
+	if pm.entry(name) != nil {
+		return fmt.Errorf(`plugin [%s] already registered`, name)
+	}
+
+	pm.entries = append(pm.entries, &pluginEntry{
+		plugin:   p,
+		routes:   routes,
+		commands: commands,
+		chats:    make(map[string]bool),
+	})
+
+	wechat.log.Infof(`插件 [%s] 注册成功 ...`, name)
+
+	return nil
+}
+
+// EnablePlugin 启用插件，chat 为空时全局启用，否则只在 GGID 为 chat 的会话中启用
+//
+// 会话中的设置优先于全局设置，全局禁用以后仍然可以在单个会话中启用
+func (wechat *WeChat) EnablePlugin(name, chat string) error {
+	return wechat.switchPlugin(name, chat, true)
+}
+
+// DisablePlugin 禁用插件，chat 为空时全局禁用，否则只在 GGID 为 chat 的会话中禁用
+func (wechat *WeChat) DisablePlugin(name, chat string) error {
+	return wechat.switchPlugin(name, chat, false)
+}
+
+func (wechat *WeChat) switchPlugin(name, chat string, enable bool) error {
+
+	pm := wechat.plugins
+	pm.Lock()
+	defer pm.Unlock()
+
+	e := pm.entry(name)
+	if e == nil {
+		return fmt.Errorf(`plugin [%s] not found`, name)
+	}
+
+	if len(chat) == 0 {
+		e.disabled = !enable
+	} else {
+		e.chats[chat] = enable
+	}
+
+	return nil
+}
+
+// Plugins 返回所有已注册插件的名称
+func (wechat *WeChat) Plugins() []string {
+
+	pm := wechat.plugins
+	pm.RLock()
+	defer pm.RUnlock()
+
+	var names []string
+	for _, e := range pm.entries {
+		names = append(names, e.plugin.Name())
+	}
+	return names
+}
+
+// activePlugins 复制当前启用的插件，调用插件代码前释放锁
+func (pm *pluginManager) activePlugins(chat string) []*pluginEntry {
+
+	pm.RLock()
+	defer pm.RUnlock()
+
+	var active []*pluginEntry
+	for _, e := range pm.entries {
+		if !e.enabledIn(chat) {
+			continue
+		}
+		active = append(active, e)
+	}
+	return active
+}
+
+func (wechat *WeChat) dispatchPlugins(evt Event) {
+
+	es := wechat.evtStream
+
+	msg, isMsg := evt.Data.(EventMsgData)
+	chat := ``
+	if isMsg {
+		chat = msg.chat()
+	}
+
+	// 自己发出的消息和补收的消息不执行命令
+	runCommands := isMsg && !msg.IsSendedByMySelf && !msg.IsBackfill
+
+	for _, e := range wechat.plugins.activePlugins(chat) {
+
+		name := e.plugin.Name()
+
+		if pattern := findMatch(e.routes, evt.Path); pattern != `` {
+			es.safeCall(name+`:`+pattern, evt, e.routes[pattern])
+		}
+
+		if runCommands && len(e.commands) > 0 {
+			if cmd, ok := parseCommand(wechat.conf.CommandPrefix, msg); ok {
+				if handler, found := e.commands[cmd.Name]; found {
+					es.safeCall(name+`:`+wechat.conf.CommandPrefix+cmd.Name, evt, func(Event) error {
+						return handler(cmd)
+					})
+				}
+			}
+		}
+	}
+}
+
+func (wechat *WeChat) shutdownPlugins() {
+
+	pm := wechat.plugins
+	pm.RLock()
+	entries := append([]*pluginEntry(nil), pm.entries...)
+	pm.RUnlock()
+
+	for _, e := range entries {
+		if err := e.plugin.Shutdown(); err != nil {
+			wechat.log.Errorf(`插件 [%s] 停止失败: %v`, e.plugin.Name(), err)
+		}
+	}
+}
+
+func parseCommand(prefix string, msg EventMsgData) (Command, bool) {
+
+	content := strings.TrimSpace(msg.text())
+	if len(prefix) == 0 || !strings.HasPrefix(content, prefix) {
+		return Command{}, false
+	}
+
+	fields := strings.Fields(content[len(prefix):])
+	if len(fields) == 0 {
+		return Command{}, false
+	}
+
+	return Command{
+		Name: fields[0],
+		Args: fields[1:],
+		Msg:  msg,
+	}, true
+}
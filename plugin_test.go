@@ -0,0 +1,62 @@
+package webot
+
+import "testing"
+
+type nopPlugin struct{ name string }
+
+func (p *nopPlugin) Name() string                             { return p.name }
+func (p *nopPlugin) Init(bot PluginBot) error                 { return nil }
+func (p *nopPlugin) Routes() map[string]func(Event) error     { return nil }
+func (p *nopPlugin) Commands() map[string]func(Command) error { return nil }
+func (p *nopPlugin) Shutdown() error                          { return nil }
+
+func TestSwitchPlugin(t *testing.T) {
+
+	cases := []struct {
+		name   string
+		setup  func(wechat *WeChat)
+		active map[string]bool // chat => 是否启用
+	}{
+		{`default`, func(wechat *WeChat) {}, map[string]bool{``: true, `a`: true, `b`: true}},
+		{`disabled in one chat`, func(wechat *WeChat) {
+			wechat.DisablePlugin(`p`, `a`)
+		}, map[string]bool{``: true, `a`: false, `b`: true}},
+		{`disabled globally`, func(wechat *WeChat) {
+			wechat.DisablePlugin(`p`, ``)
+		}, map[string]bool{``: false, `a`: false, `b`: false}},
+		{`disabled globally, enabled in one chat`, func(wechat *WeChat) {
+			wechat.DisablePlugin(`p`, ``)
+			wechat.EnablePlugin(`p`, `a`)
+		}, map[string]bool{``: false, `a`: true, `b`: false}},
+		{`enabled in one chat before disabled globally`, func(wechat *WeChat) {
+			wechat.EnablePlugin(`p`, `a`)
+			wechat.DisablePlugin(`p`, ``)
+		}, map[string]bool{``: false, `a`: true, `b`: false}},
+		{`re-disabled in chat`, func(wechat *WeChat) {
+			wechat.DisablePlugin(`p`, ``)
+			wechat.EnablePlugin(`p`, `a`)
+			wechat.DisablePlugin(`p`, `a`)
+		}, map[string]bool{``: false, `a`: false, `b`: false}},
+	}
+
+	for _, c := range cases {
+		wechat := &WeChat{plugins: newPluginManager()}
+		wechat.plugins.entries = append(wechat.plugins.entries, &pluginEntry{
+			plugin: &nopPlugin{`p`},
+			chats:  make(map[string]bool),
+		})
+
+		c.setup(wechat)
+
+		for chat, want := range c.active {
+			if got := len(wechat.plugins.activePlugins(chat)) == 1; got != want {
+				t.Errorf(`%s: active in [%s] = %v, want %v`, c.name, chat, got, want)
+			}
+		}
+	}
+
+	wechat := &WeChat{plugins: newPluginManager()}
+	if err := wechat.EnablePlugin(`missing`, ``); err == nil {
+		t.Error(`EnablePlugin of unknown plugin should fail`)
+	}
+}
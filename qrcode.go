@@ -0,0 +1,147 @@
+package webot
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// loginURL 二维码中的内容，扫码以后手机上会确认登录
+func loginURL(uuid string) string {
+	return `https://login.weixin.qq.com/l/` + uuid
+}
+
+// TerminalUUIDProcessor 在终端中直接打印二维码，适用于没有图形界面的服务器
+type TerminalUUIDProcessor struct {
+	processorLogger
+	Writer          io.Writer // 默认为 os.Stdout
+	LightBackground bool      // 终端为浅色背景时设置为 true
+}
+
+// ProcessUUID implements UUIDProcessor
+func (tp *TerminalUUIDProcessor) ProcessUUID(uuid, storage string) error {
+
+	qr, err := qrcode.New(loginURL(uuid), qrcode.Low)
+	if err != nil {
+		return err
+	}
+
+	w := tp.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+
+	if _, err = io.WriteString(w, renderHalfBlocks(qr.Bitmap(), tp.LightBackground)); err != nil {
+		return err
+	}
+	tp.logger().Info(`请使用微信扫一扫扫描二维码...`)
+
+	return nil
+}
+
+// UUIDDidConfirm implements UUIDProcessor
+func (tp *TerminalUUIDProcessor) UUIDDidConfirm(err error) {}
+
+// renderHalfBlocks 每个字符表示上下两个模块，终端中的二维码接近正方形
+func renderHalfBlocks(bitmap [][]bool, lightBackground bool) string {
+
+	// 深色背景的终端中字符是亮的，需要画出二维码中的浅色模块
+	filled := func(y, x int) bool {
+		if y >= len(bitmap) {
+			return !lightBackground
+		}
+		return bitmap[y][x] == lightBackground
+	}
+
+	var sb strings.Builder
+	for y := 0; y < len(bitmap); y += 2 {
+		for x := range bitmap[y] {
+			top, bottom := filled(y, x), filled(y+1, x)
+			switch {
+			case top && bottom:
+				sb.WriteString(`█`)
+			case top:
+				sb.WriteString(`▀`)
+			case bottom:
+				sb.WriteString(`▄`)
+			default:
+				sb.WriteString(` `)
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// FileUUIDProcessor 在本地生成二维码图片并写入 Path
+type FileUUIDProcessor struct {
+	processorLogger
+	Path string // 默认为 Storage/qrcode.png
+	Size int    // 图片边长，默认 256
+}
+
+// ProcessUUID implements UUIDProcessor
+func (fp *FileUUIDProcessor) ProcessUUID(uuid, storage string) error {
+
+	path := fp.Path
+	if len(path) == 0 {
+		path = filepath.Join(storage, `qrcode.png`)
+	}
+	size := fp.Size
+	if size <= 0 {
+		size = 256
+	}
+
+	if err := qrcode.WriteFile(loginURL(uuid), qrcode.Medium, size, path); err != nil {
+		return err
+	}
+	fp.logger().Infof(`二维码已保存到 [%s]，请使用微信扫一扫扫描二维码...`, path)
+
+	return nil
+}
+
+// UUIDDidConfirm implements UUIDProcessor
+func (fp *FileUUIDProcessor) UUIDDidConfirm(err error) {}
+
+// CallbackUUIDProcessor 把登录地址交给调用者处理，例如推送到 IM 或者网页
+type CallbackUUIDProcessor struct {
+	OnLoginURL func(loginURL string) error
+	OnConfirm  func(err error)
+	OnScanned  func(avatar []byte)
+	OnExpired  func()
+}
+
+// ProcessUUID implements UUIDProcessor
+func (cp *CallbackUUIDProcessor) ProcessUUID(uuid, storage string) error {
+	if cp.OnLoginURL == nil {
+		return nil
+	}
+	return cp.OnLoginURL(loginURL(uuid))
+}
+
+// UUIDDidConfirm implements UUIDProcessor
+func (cp *CallbackUUIDProcessor) UUIDDidConfirm(err error) {
+	if cp.OnConfirm != nil {
+		cp.OnConfirm(err)
+	}
+}
+
+// Scanned implements LoginObserver
+func (cp *CallbackUUIDProcessor) Scanned(avatar []byte) {
+	if cp.OnScanned != nil {
+		cp.OnScanned(avatar)
+	}
+}
+
+// Expired implements LoginObserver
+func (cp *CallbackUUIDProcessor) Expired() {
+	if cp.OnExpired != nil {
+		cp.OnExpired()
+	}
+}
+
+// Refreshed implements LoginObserver, 新的登录地址已经通过 OnLoginURL 传出
+func (cp *CallbackUUIDProcessor) Refreshed(uuid string) {}
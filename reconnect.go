@@ -0,0 +1,71 @@
+package webot
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy 登录失败以后重新登录的策略
+type ReconnectPolicy struct {
+	InitialDelay time.Duration   // 第一次重试前等待的时间
+	MaxDelay     time.Duration   // 最长等待时间
+	Multiplier   float64         // 每次失败以后等待时间的倍数
+	Jitter       float64         // 随机抖动的比例，0 ~ 1
+	MaxAttempts  int             // 连续失败多少次以后放弃，0 为不限制
+	OnGiveUp     func(err error) // 放弃重连时调用
+}
+
+// DefaultReconnectPolicy 5 秒开始指数退避，最长 10 分钟，不限次数
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		InitialDelay: 5 * time.Second,
+		MaxDelay:     10 * time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// Delay 第 attempt 次失败以后需要等待的时间
+func (rp *ReconnectPolicy) Delay(attempt int) time.Duration {
+
+	delay := float64(rp.InitialDelay)
+	if delay <= 0 {
+		delay = float64(5 * time.Second)
+	}
+	multiplier := rp.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	for i := 1; i < attempt && (rp.MaxDelay <= 0 || delay < float64(rp.MaxDelay)); i++ {
+		delay *= multiplier
+	}
+
+	// 先加抖动再限制最大值，保证不会超过 MaxDelay
+	if rp.Jitter > 0 {
+		delay += delay * rp.Jitter * (rand.Float64()*2 - 1)
+	}
+	if rp.MaxDelay > 0 && delay > float64(rp.MaxDelay) {
+		delay = float64(rp.MaxDelay)
+	}
+
+	return time.Duration(delay)
+}
+
+// EventRetryData /reconnect/retry 事件，登录失败准备重试时产生
+type EventRetryData struct {
+	Attempt int           // 连续失败的次数
+	Delay   time.Duration // 下一次重试前等待的时间
+	Err     error
+}
+
+func (wechat *WeChat) reconnectPolicy() *ReconnectPolicy {
+	if wechat.conf.Reconnect != nil {
+		return wechat.conf.Reconnect
+	}
+	return DefaultReconnectPolicy()
+}
+
+// notifyLoginState 发送 /login 事件，-1 登录失败 1 登录成功
+func (wechat *WeChat) notifyLoginState(state int) {
+	wechat.emit(`Login`, `Wechat`, `/login`, state)
+}
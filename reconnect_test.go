@@ -0,0 +1,41 @@
+package webot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+
+	policy := ReconnectPolicy{
+		InitialDelay: 5 * time.Second,
+		MaxDelay:     10 * time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+
+	cases := []struct {
+		name     string
+		policy   ReconnectPolicy
+		attempt  int
+		min, max time.Duration
+	}{
+		{`first`, policy, 1, 4 * time.Second, 6 * time.Second},
+		{`doubled`, policy, 3, 16 * time.Second, 24 * time.Second},
+		{`capped`, policy, 8, 8 * time.Minute, 10 * time.Minute},
+		{`far beyond cap`, policy, 100, 8 * time.Minute, 10 * time.Minute},
+		{`no jitter`, ReconnectPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 3}, 3, 9 * time.Second, 9 * time.Second},
+		{`default initial delay`, ReconnectPolicy{}, 5, 5 * time.Second, 5 * time.Second},
+		{`no cap`, ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2}, 11, 1024 * time.Second, 1024 * time.Second},
+	}
+
+	for _, c := range cases {
+		// 抖动是随机的，多试几次
+		for i := 0; i < 1000; i++ {
+			if d := c.policy.Delay(c.attempt); d < c.min || d > c.max {
+				t.Errorf(`%s: Delay(%d) = %v, want between %v and %v`, c.name, c.attempt, d, c.min, c.max)
+				break
+			}
+		}
+	}
+}
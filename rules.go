@@ -0,0 +1,346 @@
+package webot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const rulesReloadInterval = 5 * time.Second
+
+// Rule 自动回复规则
+type Rule struct {
+	Name     string      `json:"name" yaml:"name"`
+	Match    RuleMatcher `json:"match" yaml:"match"`
+	Action   RuleAction  `json:"action" yaml:"action"`
+	Cooldown string      `json:"cooldown" yaml:"cooldown"` // 同一会话两次触发的最小间隔, 例如 `30s`
+}
+
+// RuleMatcher 规则的匹配条件，所有非空条件都满足时才算匹配
+type RuleMatcher struct {
+	Exact    string   `json:"exact" yaml:"exact"`
+	Contains []string `json:"contains" yaml:"contains"` // 包含任意一个即可
+	Regex    string   `json:"regex" yaml:"regex"`
+	AtMe     bool     `json:"at_me" yaml:"at_me"`
+	Sender   string   `json:"sender" yaml:"sender"` // solo | group | self
+	Groups   []string `json:"groups" yaml:"groups"` // 群 GGID 或者群昵称白名单
+}
+
+// RuleAction 规则匹配以后的动作
+type RuleAction struct {
+	Type  string `json:"type" yaml:"type"` // text | file | forward | event
+	Text  string `json:"text" yaml:"text"`
+	File  string `json:"file" yaml:"file"`
+	To    string `json:"to" yaml:"to"` // forward 的目标，GGID 或者 UserName
+	Event string `json:"event" yaml:"event"`
+}
+
+// EventRuleData 规则触发的自定义事件
+type EventRuleData struct {
+	Rule string
+	Msg  EventMsgData
+}
+
+type rulesFile struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+type compiledRule struct {
+	Rule
+	regex    *regexp.Regexp
+	cooldown time.Duration
+	last     map[string]time.Time
+}
+
+type rulesEngine struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	rules   []*compiledRule
+	stop    chan struct{} // 不为空时正在监视规则文件
+}
+
+// replace 替换规则，同名规则保留冷却状态，避免重新加载以后 self 规则再次循环回复
+func (re *rulesEngine) replace(rules []*compiledRule) {
+	old := make(map[string]*compiledRule, len(re.rules))
+	for _, r := range re.rules {
+		old[r.Name] = r
+	}
+	for _, r := range rules {
+		if o, found := old[r.Name]; found {
+			r.last = o.last
+		}
+	}
+	re.rules = rules
+}
+
+func loadRules(path string) ([]*compiledRule, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rf rulesFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case `.yml`, `.yaml`:
+		err = yaml.Unmarshal(data, &rf)
+	default:
+		err = json.Unmarshal(data, &rf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*compiledRule
+	for i, r := range rf.Rules {
+		cr := &compiledRule{Rule: r, last: make(map[string]time.Time)}
+		if len(cr.Name) == 0 {
+			cr.Name = fmt.Sprintf(`rule-%d`, i)
+		}
+		if len(r.Match.Regex) > 0 {
+			if cr.regex, err = regexp.Compile(r.Match.Regex); err != nil {
+				return nil, fmt.Errorf(`rule [%s] regex: %v`, cr.Name, err)
+			}
+		}
+		if len(r.Cooldown) > 0 {
+			if cr.cooldown, err = time.ParseDuration(r.Cooldown); err != nil {
+				return nil, fmt.Errorf(`rule [%s] cooldown: %v`, cr.Name, err)
+			}
+		}
+		switch r.Action.Type {
+		case `text`, `file`, `forward`, `event`:
+		default:
+			return nil, fmt.Errorf(`rule [%s] unknown action type [%s]`, cr.Name, r.Action.Type)
+		}
+		rules = append(rules, cr)
+	}
+
+	return rules, nil
+}
+
+// LoadRules 加载规则文件(.json/.yml/.yaml), 文件修改后会自动重新加载
+func (wechat *WeChat) LoadRules(path string) error {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	rules, err := loadRules(path)
+	if err != nil {
+		return err
+	}
+
+	re := wechat.rules
+	re.Lock()
+	re.path = path
+	re.modTime = info.ModTime()
+	re.replace(rules)
+	stop := re.stop
+	if stop == nil {
+		stop = make(chan struct{})
+		re.stop = stop
+		go wechat.watchRules(stop)
+	}
+	re.Unlock()
+
+	wechat.log.Infof(`加载了 [%d] 条自动回复规则 ...`, len(rules))
+
+	return nil
+}
+
+// stopRules 停止监视规则文件，已经加载的规则继续有效
+func (wechat *WeChat) stopRules() {
+	re := wechat.rules
+	re.Lock()
+	if re.stop != nil {
+		close(re.stop)
+		re.stop = nil
+	}
+	re.Unlock()
+}
+
+func (wechat *WeChat) watchRules(stop chan struct{}) {
+
+	re := wechat.rules
+
+	tick := time.NewTicker(rulesReloadInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+
+		re.Lock()
+		path, modTime := re.path, re.modTime
+		re.Unlock()
+
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().After(modTime) {
+			continue
+		}
+
+		rules, err := loadRules(path)
+		if err != nil {
+			wechat.log.Errorf(`重新加载规则文件失败，继续使用旧规则: %v`, err)
+			re.Lock()
+			re.modTime = info.ModTime()
+			re.Unlock()
+			continue
+		}
+
+		re.Lock()
+		re.modTime = info.ModTime()
+		re.replace(rules)
+		re.Unlock()
+
+		wechat.log.Infof(`规则文件发生变化，重新加载了 [%d] 条规则 ...`, len(rules))
+	}
+}
+
+func (wechat *WeChat) applyRules(evt Event) {
+
+	msg, ok := evt.Data.(EventMsgData)
+	if !ok || msg.IsBackfill {
+		return
+	}
+
+	re := wechat.rules
+	re.Lock()
+	var matched []*compiledRule
+	now := time.Now()
+	for _, r := range re.rules {
+		if !wechat.ruleMatch(r, msg) {
+			continue
+		}
+		chat := msg.chat()
+		if r.cooldown > 0 && now.Sub(r.last[chat]) < r.cooldown {
+			wechat.log.Debugf(`规则 [%s] 冷却中 ...`, r.Name)
+			continue
+		}
+		r.last[chat] = now
+		matched = append(matched, r)
+	}
+	re.Unlock()
+
+	for _, r := range matched {
+		r := r
+		wechat.evtStream.safeCall(`rule:`+r.Name, evt, func(Event) error {
+			return wechat.doRuleAction(r, msg)
+		})
+	}
+}
+
+func (wechat *WeChat) ruleMatch(r *compiledRule, msg EventMsgData) bool {
+
+	m := r.Match
+
+	// 自己发的消息默认不处理，避免回复自己造成死循环
+	switch m.Sender {
+	case `self`:
+		if !msg.IsSendedByMySelf {
+			return false
+		}
+	case `solo`:
+		if msg.IsSendedByMySelf || msg.IsGroupMsg {
+			return false
+		}
+	case `group`:
+		if msg.IsSendedByMySelf || !msg.IsGroupMsg {
+			return false
+		}
+	default:
+		if msg.IsSendedByMySelf {
+			return false
+		}
+	}
+
+	if m.AtMe && !msg.AtMe {
+		return false
+	}
+
+	content := strings.TrimSpace(msg.text())
+
+	if len(m.Exact) > 0 && content != m.Exact {
+		return false
+	}
+
+	if len(m.Contains) > 0 {
+		found := false
+		for _, c := range m.Contains {
+			if strings.Contains(content, c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.regex != nil && !r.regex.MatchString(content) {
+		return false
+	}
+
+	if len(m.Groups) > 0 {
+		if !msg.IsGroupMsg {
+			return false
+		}
+		group, err := wechat.ContactByUserName(msg.groupUserName())
+		if err != nil {
+			return false
+		}
+		allowed := false
+		for _, g := range m.Groups {
+			if g == group.GGID || g == group.NickName {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (wechat *WeChat) doRuleAction(r *compiledRule, msg EventMsgData) error {
+
+	a := r.Action
+	to := msg.chatUserName()
+
+	wechat.log.Debugf(`触发规则 [%s] ...`, r.Name)
+
+	switch a.Type {
+	case `text`:
+		return wechat.SendTextMsg(a.Text, to)
+	case `file`:
+		return wechat.SendFile(a.File, to)
+	case `forward`:
+		target := a.To
+		if c, err := wechat.ContactByGGID(a.To); err == nil {
+			target = c.UserName
+		}
+		return wechat.Forward(msg, target)
+	case `event`:
+		wechat.emit(`Rule`, r.Name, cleanPath(a.Event), EventRuleData{
+			Rule: r.Name,
+			Msg:  msg,
+		})
+	}
+
+	return nil
+}
@@ -2,28 +2,60 @@ package webot
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const success = `0`
+// SyncKeyPair 一个同步点
+type SyncKeyPair struct {
+	Key int64
+	Val int64
+}
+
+// SyncKey webwxinit 和 webwxsync 返回的同步点，下一次同步从这里开始
+type SyncKey struct {
+	Count int
+	List  []SyncKeyPair
+}
+
+// String synccheck 使用的格式 key_val|key_val
+func (sk *SyncKey) String() string {
+	if sk == nil {
+		return ``
+	}
+	pairs := make([]string, len(sk.List))
+	for i, kv := range sk.List {
+		pairs[i] = fmt.Sprintf(`%d_%d`, kv.Key, kv.Val)
+	}
+	return strings.Join(pairs, `|`)
+}
+
+// IsEmpty 没有任何同步点
+func (sk *SyncKey) IsEmpty() bool {
+	return sk == nil || len(sk.List) == 0
+}
 
 type syncMessageRequest struct {
-	SyncKey     map[string]interface{}
+	SyncKey     *SyncKey
 	RR          int64 `json:"rr"`
 	BaseRequest *BaseRequest
 }
 
 type syncMessageResponse struct {
 	Response
-	SyncKey      map[string]interface{}
-	SyncCheckKey map[string]interface{}
+	SyncKey      *SyncKey
+	SyncCheckKey *SyncKey
 	SKey         string
 	ContinueFlag int
 
@@ -44,67 +76,235 @@ type CountedContent struct {
 	Content []map[string]interface{}
 }
 
+const (
+	// SyncStateConnected 同步正常
+	SyncStateConnected = `connected`
+	// SyncStateRetrying 网络错误，正在退避重试
+	SyncStateRetrying = `retrying`
+	// SyncStateLoggedOut 在手机上退出或者在其他地方登录，需要重新登录
+	SyncStateLoggedOut = `logged_out`
+	// SyncStateFailed 无法继续同步
+	SyncStateFailed = `failed`
+)
+
+// synccheck 返回的 selector
+const (
+	selectorNone     = 0
+	selectorNewMsg   = 2
+	selectorContact  = 4
+	selectorMod      = 6
+	selectorActivity = 7
+)
+
+var selectorDesc = map[int]string{
+	selectorNewMsg:   `新消息`,
+	selectorContact:  `联系人变更`,
+	selectorMod:      `消息或联系人变更`,
+	selectorActivity: `手机端操作`,
+}
+
+// EventSyncData /sys/sync 事件，同步状态发生变化时产生
+type EventSyncData struct {
+	State   string
+	Host    string
+	Retcode int
+	Attempt int           // 连续失败的次数
+	Delay   time.Duration // 下一次重试前等待的时间
+	Err     error
+}
+
+func (wechat *WeChat) emitSyncEvent(data EventSyncData) {
+	data.Host = wechat.syncHost
+	wechat.emit(`Sync`, `Server`, `/sys/sync`, data)
+}
+
+// syncBackoff 第 attempt 次失败以后需要等待的时间，指数增长，最长 1 分钟
+func syncBackoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = 2 * time.Second
+	}
+	delay := base
+	for i := 1; i < attempt && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	if delay > time.Minute {
+		delay = time.Minute
+	}
+	return delay
+}
+
 // listen did hold a long connection, retrun data by 4 chans.
 func (wechat *WeChat) beginSync() error {
 
-	log.Info(`进行同步线路测试 ...`)
+	wechat.log.Info(`进行同步线路测试 ...`)
 
-	didGetSyncHost := wechat.choseAvalibleSyncHost()
+	didGetSyncHost := wechat.choseAvalibleSyncHost(false)
 
 	if !didGetSyncHost {
-		return fmt.Errorf(`无法同步可用主机，请重新登录...`)
+		err := errors.New(`no available sync host`)
+		wechat.emitSyncEvent(EventSyncData{State: SyncStateFailed, Err: err})
+		return err
+	}
+
+	wechat.log.Infof(`发现主机: [%s], 开始同步 ... ...`, wechat.syncHost)
+	wechat.health.mark(&wechat.health.lastSyncCheck)
+	wechat.emitSyncEvent(EventSyncData{State: SyncStateConnected})
+
+	failures, slow := 0, 0
+
+	// 网络错误时退避重试，超过次数以后放弃，交给 keepAlive 重新登录
+	retry := func(err error) error {
+		failures++
+		if failures > wechat.conf.SyncRetry {
+			wechat.emitSyncEvent(EventSyncData{State: SyncStateFailed, Attempt: failures, Err: err})
+			return err
+		}
+		delay := syncBackoff(wechat.conf.SyncBackoff, failures)
+		wechat.log.Warnf(`同步失败: %v, %v 后进行第 %d 次重试 ...`, err, delay, failures)
+		wechat.emitSyncEvent(EventSyncData{State: SyncStateRetrying, Attempt: failures, Delay: delay, Err: err})
+		time.Sleep(delay)
+		return nil
 	}
 
-	log.Infof(`发现主机: [%s], 开始同步 ... ...`, wechat.syncHost)
+	// 补收失败时不能继续普通同步，否则剩下的消息会被当作新消息
+	if wechat.backfill != nil {
+		if err := wechat.runBackfill(retry); err != nil {
+			return err
+		}
+		failures = 0
+	}
 
 	for {
-		log.Info(`消息同步中 ....`)
+		wechat.log.Info(`消息同步中 ....`)
 
+		start := time.Now()
 		code, selector, err := wechat.syncCheck()
 
 		if err != nil {
+			if err = retry(err); err != nil {
+				return err
+			}
+			// 连续失败时换一个主机试试
+			if failures > 1 {
+				wechat.choseAvalibleSyncHost(true)
+			}
+			continue
+		}
+
+		// 长轮询通常 25 秒左右返回，连续多次过慢时重新挑选主机
+		if threshold := wechat.conf.SyncSlowThreshold; threshold > 0 && time.Since(start) > threshold {
+			slow++
+		} else {
+			slow = 0
+		}
+		if slow >= 3 {
+			slow = 0
+			wechat.log.Warnf(`[%s] 响应过慢，重新进行同步线路测试 ...`, wechat.syncHost)
+			wechat.choseAvalibleSyncHost(true)
+		}
+
+		if code != 0 {
+			err = &APIError{Ret: code, Endpoint: `synccheck`}
+			state := SyncStateFailed
+			if errors.Is(err, ErrSessionExpired) {
+				state = SyncStateLoggedOut
+			}
+			wechat.log.Errorf(`同步失败: %v`, err)
+			wechat.emitSyncEvent(EventSyncData{State: state, Retcode: code, Err: err})
 			return err
 		}
 
-		if code != success {
-			return fmt.Errorf(`同步失败，请重新登录... [code]=%s`, code)
+		if selector == selectorNone {
+			wechat.log.Debug(`服务器无返回消息...`)
+			if failures > 0 {
+				failures = 0
+				wechat.emitSyncEvent(EventSyncData{State: SyncStateConnected})
+			}
+			continue
 		}
 
-		if selector == `0` {
-			log.Debug(`服务器无返回消息...`)
-		} else {
-			continueFlag := -1
-			for continueFlag != 0 {
-				resp, err := wechat.sync()
-				if err != nil {
-					log.Error("同步消息失败：%s...", err)
-					return errors.New(`同步消息失败`)
-				}
-				continueFlag = resp.ContinueFlag
-
-				if resp.ModContactCount > 0 {
-					wechat.contactDidChange(resp.ModContactList, Modify)
-				}
-				if resp.DelContactCount > 0 {
-					wechat.contactDidChange(resp.DelContactList, Delete)
-				}
-				if resp.ModChatRoomMemberCount > 0 {
-					wechat.groupMemberDidChange(resp.ModChatRoomMemberList)
-				}
-				log.Debugf(`服务器同步简介:
+		wechat.log.Debugf(`selector [%d]: %s`, selector, selectorDesc[selector])
+
+		if _, err = wechat.syncMessages(nil); err != nil {
+			wechat.log.Errorf("同步消息失败：%s...", err)
+			if errors.Is(err, ErrSessionExpired) {
+				wechat.emitSyncEvent(EventSyncData{State: SyncStateLoggedOut, Err: err})
+				return err
+			}
+			if err = retry(err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if failures > 0 {
+			failures = 0
+			wechat.emitSyncEvent(EventSyncData{State: SyncStateConnected})
+		}
+	}
+}
+
+// syncMessages 调用 webwxsync 直到服务器没有更多的数据，补收消息时返回补收的数目
+func (wechat *WeChat) syncMessages(backfill *syncPoint) (int, error) {
+
+	count := 0
+	continueFlag := -1
+	for continueFlag != 0 {
+		resp, err := wechat.sync()
+		if err != nil {
+			return count, err
+		}
+		continueFlag = resp.ContinueFlag
+
+		if resp.ModContactCount > 0 {
+			wechat.contactDidChange(resp.ModContactList, Modify)
+		}
+		if resp.DelContactCount > 0 {
+			wechat.contactDidChange(resp.DelContactList, Delete)
+		}
+		if resp.ModChatRoomMemberCount > 0 {
+			wechat.groupMemberDidChange(resp.ModChatRoomMemberList)
+		}
+		wechat.log.Debugf(`服务器同步简介:
 新增消息数目	  : %d
 变更联系人数目    : %d
 删除联系人数目    : %d
 群组联系人数目    : %d `,
-					resp.AddMsgCount, resp.ModContactCount,
-					resp.DelContactCount, resp.ModChatRoomMemberCount)
-				go wechat.handleServerEvent(resp)
-			}
+			resp.AddMsgCount, resp.ModContactCount,
+			resp.DelContactCount, resp.ModChatRoomMemberCount)
+		if backfill != nil {
+			count += wechat.handleServerEvent(resp, backfill)
+		} else {
+			go wechat.handleServerEvent(resp, nil)
 		}
 	}
+
+	return count, nil
+}
+
+func (wechat *WeChat) syncCheck() (int, int, error) {
+
+	start := time.Now()
+	code, selector, cookies, err := wechat.syncCheckHost(context.Background(), wechat.syncHost)
+	wechat.metrics.observe(`webot_synccheck_duration_seconds`, ``, time.Since(start))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(cookies) > 0 {
+		wechat.refreshCookieCache(cookies)
+	}
+	wechat.refreshBaseInfo()
+
+	if code == 0 {
+		wechat.health.mark(&wechat.health.lastSyncCheck)
+	}
+
+	return code, selector, nil
 }
 
-func (wechat *WeChat) syncCheck() (string, string, error) {
+// syncCheckHost 向 host 发起一次 synccheck，不修改任何状态
+func (wechat *WeChat) syncCheckHost(ctx context.Context, host string) (int, int, []*http.Cookie, error) {
 
 	info := url.Values{}
 	info.Add("r", fmt.Sprintf("%v", time.Now().Unix()*1000))
@@ -114,114 +314,148 @@ func (wechat *WeChat) syncCheck() (string, string, error) {
 	info.Add("synckey", wechat.formattedSyncCheckKey())
 	info.Add("_", fmt.Sprintf("%v", time.Now().Unix()*1000))
 
-	url, _ := url.Parse(fmt.Sprintf("https://%s/cgi-bin/mmwebwx-bin/synccheck", wechat.syncHost))
+	url, _ := url.Parse(fmt.Sprintf("https://%s/cgi-bin/mmwebwx-bin/synccheck", host))
 	url.RawQuery = info.Encode()
 
-	resp, err := wechat.Client.Get(url.String())
+	req, err := http.NewRequest(`GET`, url.String(), nil)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	resp, err := wechat.Client.Do(req.WithContext(ctx))
 
 	if err != nil {
-		return ``, ``, err
+		return 0, 0, nil, err
 	}
 	defer resp.Body.Close()
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return ``, ``, err
+		return 0, 0, nil, err
 	}
 
 	ds := string(data)
 
-	//log.Debug(ds)
+	// window.synccheck={retcode:"0",selector:"2"}
+	code, err := search(ds, `retcode:"`, `"`)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	selector, err := search(ds, `selector:"`, `"`)
+	if err != nil {
+		return 0, 0, nil, err
+	}
 
-	// TOOD need handle this error
-	code, _ := search(ds, `window.synccheck={retcode:"`, `"`)
+	c, _ := strconv.Atoi(code)
+	sel, _ := strconv.Atoi(selector)
 
-	selector, err := search(ds, `window.synccheck={retcode:"0",selector:"`, `"}`)
+	return c, sel, resp.Cookies(), nil
+}
 
-	//
-	if len(resp.Cookies()) > 0 {
-		wechat.refreshCookieCache(resp.Cookies())
+var syncHosts = [...]string{
+	`webpush.wx.qq.com`,
+	`wx2.qq.com`,
+	`webpush.wx2.qq.com`,
+	`wx8.qq.com`,
+	`webpush.wx8.qq.com`,
+	`qq.com`,
+	`web2.wechat.com`,
+	`webpush.web2.wechat.com`,
+	`wechat.com`,
+	`webpush.web.wechat.com`,
+	`webpush.weixin.qq.com`,
+	`webpush.wechat.com`,
+	`webpush1.wechat.com`,
+	`webpush2.wechat.com`,
+	`webpush2.wx.qq.com`}
+
+// probeSyncHost 在 SyncProbeTimeout 内判断 host 是否可用
+func (wechat *WeChat) probeSyncHost(host string) bool {
+
+	timeout := wechat.conf.SyncProbeTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
 	}
-	wechat.refreshBaseInfo()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wrote int32
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			atomic.StoreInt32(&wrote, 1)
+		},
+	})
 
-	return code, selector, err
-}
-
-func (wechat *WeChat) choseAvalibleSyncHost() bool {
-	hosts := [...]string{
-		`webpush.wx.qq.com`,
-		`wx2.qq.com`,
-		`webpush.wx2.qq.com`,
-		`wx8.qq.com`,
-		`webpush.wx8.qq.com`,
-		`qq.com`,
-		`webpush.wx.qq.com`,
-		`web2.wechat.com`,
-		`webpush.web2.wechat.com`,
-		`wechat.com`,
-		`webpush.web.wechat.com`,
-		`webpush.weixin.qq.com`,
-		`webpush.wechat.com`,
-		`webpush1.wechat.com`,
-		`webpush2.wechat.com`,
-		`webpush2.wx.qq.com`}
-
-	for _, host := range hosts {
-		log.Debugf("尝试连接: [%s] ... ... ", host)
-		wechat.syncHost = host
-		code, _, _ := wechat.syncCheck()
-		if code == `0` {
-			return true
-		}
-		log.Errorf("[%s] 连接失败 ... ...", host)
+	code, _, _, err := wechat.syncCheckHost(ctx, host)
+	if err == nil {
+		return code == 0
 	}
 
-	return false
+	// 没有新消息时服务器会 hold 住长轮询，请求已经发出但超时同样说明主机可用
+	return ctx.Err() == context.DeadlineExceeded && atomic.LoadInt32(&wrote) == 1
 }
 
-func (wechat *WeChat) formattedSyncCheckKey() string {
+// choseAvalibleSyncHost 优先使用上一次的主机，不可用时并发测试所有主机，取最先可用的一个
+//
+// switchHost 为 true 时不再测试当前主机，没有其他可用主机时继续使用当前主机
+func (wechat *WeChat) choseAvalibleSyncHost(switchHost bool) bool {
 
-	keys, _ := wechat.syncKey["List"].([]interface{})
-	//
-	// if keys == nil || len(keys) == 0 {
-	// 	keys, _ = wechat.SyncKey["List"].([]interface{})
-	// }
+	if last := wechat.syncHost; len(last) > 0 && !switchHost {
+		wechat.log.Debugf("尝试连接: [%s] ... ... ", last)
+		if wechat.probeSyncHost(last) {
+			return true
+		}
+		wechat.log.Errorf("[%s] 连接失败 ... ...", last)
+	}
 
-	synckeys := make([]string, 0)
+	found := make(chan string, len(syncHosts))
+	var wg sync.WaitGroup
 
-	for _, key := range keys {
-		kv, ok := key.(map[string]interface{})
-		if ok {
-			f, _ := kv["Val"].(float64)
-			synckeys = append(synckeys, fmt.Sprintf("%v_%v", kv["Key"], int64(f)))
+	for _, host := range syncHosts {
+		if host == wechat.syncHost {
+			continue
 		}
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if wechat.probeSyncHost(host) {
+				found <- host
+			} else {
+				wechat.log.Debugf("[%s] 连接失败 ... ...", host)
+			}
+		}(host)
 	}
 
-	return strings.Join(synckeys, "|")
-}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
 
-func (wechat *WeChat) sync() (*syncMessageResponse, error) {
+	host, ok := <-found
+	if !ok {
+		if switchHost && len(wechat.syncHost) > 0 {
+			wechat.log.Warnf(`没有其他可用的主机，继续使用 [%s] ...`, wechat.syncHost)
+			return true
+		}
+		return false
+	}
 
-	// 由于go会将int64转换为float64， 所以做了这个恶心的动作
-	syncKeyf := make(map[string]interface{}, 0)
-	keys := strings.Split(wechat.formattedSyncCheckKey(), "|")
+	wechat.syncHost = host
+	wechat.health.setSyncHost(host)
+	wechat.refreshBaseInfo()
 
-	syncKeyf["Count"] = len(keys)
+	return true
+}
 
-	list := make([]map[string]int64, 0)
+func (wechat *WeChat) formattedSyncCheckKey() string {
+	return wechat.syncKey.String()
+}
 
-	for _, key := range keys {
-		kv := strings.Split(key, "_")
-		k, _ := strconv.ParseInt(kv[0], 10, 64)
-		v, _ := strconv.ParseInt(kv[1], 10, 64)
-		kvmap := map[string]int64{"Key": k, "Val": v}
-		list = append(list, kvmap)
-	}
-	syncKeyf["List"] = list
+func (wechat *WeChat) sync() (*syncMessageResponse, error) {
 
 	data, err := json.Marshal(syncMessageRequest{
 		BaseRequest: wechat.BaseRequest,
-		SyncKey:     syncKeyf,
+		SyncKey:     wechat.syncKey,
 		RR:          ^time.Now().Unix(),
 	})
 
@@ -238,11 +472,15 @@ func (wechat *WeChat) sync() (*syncMessageResponse, error) {
 		return nil, err
 	}
 
-	if resp.SyncCheckKey != nil {
+	if !resp.SyncCheckKey.IsEmpty() {
 		wechat.syncKey = resp.SyncCheckKey
-	} else {
+	} else if !resp.SyncKey.IsEmpty() {
 		wechat.syncKey = resp.SyncKey
 	}
 
+	// 每次同步以后保存同步点，恢复登录时从这里继续
+	wechat.refreshBaseInfo()
+	wechat.health.mark(&wechat.health.lastSync)
+
 	return resp, nil
 }
@@ -0,0 +1,125 @@
+package webot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Transcriber 语音转文字，收到语音消息时自动调用，结果保存在 EventMsgData.Transcript
+type Transcriber interface {
+	// Transcribe format 为音频格式，网页版微信的语音为 mp3
+	Transcribe(audio io.Reader, format string) (string, error)
+}
+
+// CommandTranscriber 调用本地命令 (例如离线 ASR 程序) 识别语音
+//
+// Args 中的 {input} 会被替换为语音文件的路径，没有 {input} 时语音从 stdin 传入，识别结果从 stdout 读取。
+// Transcode 不为空时先执行转码命令，例如 []string{`ffmpeg`, `-y`, `-i`, `{input}`, `-ar`, `16000`, `{output}`}
+type CommandTranscriber struct {
+	Command         string
+	Args            []string
+	Transcode       []string
+	TranscodeFormat string // 转码后的格式，默认 wav
+	Timeout         time.Duration
+}
+
+// Transcribe implements Transcriber
+func (ct *CommandTranscriber) Transcribe(audio io.Reader, format string) (string, error) {
+
+	timeout := ct.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dir, err := ioutil.TempDir(``, `webot-voice`)
+	if err != nil {
+		return ``, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, `voice.`+format)
+	data, err := ioutil.ReadAll(audio)
+	if err != nil {
+		return ``, err
+	}
+	if err = ioutil.WriteFile(input, data, 0644); err != nil {
+		return ``, err
+	}
+
+	if len(ct.Transcode) > 0 {
+		tf := ct.TranscodeFormat
+		if len(tf) == 0 {
+			tf = `wav`
+		}
+		output := filepath.Join(dir, `voice-transcoded.`+tf)
+		args := replaceArgs(ct.Transcode[1:], input, output)
+		if out, e := exec.CommandContext(ctx, ct.Transcode[0], args...).CombinedOutput(); e != nil {
+			return ``, fmt.Errorf(`transcode failed: %v %s`, e, out)
+		}
+		input = output
+	}
+
+	cmd := exec.CommandContext(ctx, ct.Command, replaceArgs(ct.Args, input, ``)...)
+
+	usesFile := false
+	for _, a := range ct.Args {
+		if strings.Contains(a, `{input}`) {
+			usesFile = true
+			break
+		}
+	}
+	if !usesFile {
+		file, e := os.Open(input)
+		if e != nil {
+			return ``, e
+		}
+		defer file.Close()
+		cmd.Stdin = file
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		return ``, fmt.Errorf(`transcribe failed: %v %s`, err, stderr.String())
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func replaceArgs(args []string, input, output string) []string {
+	replaced := make([]string, len(args))
+	for i, a := range args {
+		a = strings.Replace(a, `{input}`, input, -1)
+		replaced[i] = strings.Replace(a, `{output}`, output, -1)
+	}
+	return replaced
+}
+
+func (wechat *WeChat) transcribe(data *EventMsgData) {
+
+	buf := new(bytes.Buffer)
+	if _, err := wechat.DownloadTo(data.MediaURL, buf); err != nil {
+		wechat.log.Errorf(`下载语音失败 [%s]: %v`, data.MsgID, err)
+		return
+	}
+
+	text, err := wechat.conf.Transcriber.Transcribe(buf, `mp3`)
+	if err != nil {
+		wechat.log.Errorf(`语音识别失败 [%s]: %v`, data.MsgID, err)
+		return
+	}
+
+	data.Transcript = text
+}
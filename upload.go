@@ -0,0 +1,231 @@
+package webot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/h2non/filetype.v1"
+)
+
+const (
+	// 网页版微信上传文件时的分片大小
+	uploadChunkSize = 512 * 1024
+	// 单个分片在一个上传主机上的重试次数
+	uploadChunkRetry = 3
+)
+
+// UploadOptions 上传附件时的参数
+type UploadOptions struct {
+	Name     string
+	Size     int64  // 必填，必须等于 r 中数据的长度
+	MIME     string // 为空时根据内容自动识别
+	ModTime  time.Time
+	MD5      string
+	To       string
+	Progress func(sent, total int64) // 每个分片上传成功后回调
+}
+
+// UploadStream 以流的方式上传附件，大文件会被切分成多个分片，每次只在内存中保留一个分片
+//
+// 分片按 opt.Size 计算，r 中的数据比 Size 多或者少都会返回错误
+// 一个上传主机失败以后需要从第一个分片重新上传，只有 r 实现了 io.Seeker 时才会切换主机
+func (wechat *WeChat) UploadStream(r io.Reader, opt UploadOptions) (string, error) {
+
+	if opt.Size <= 0 {
+		return ``, errors.New(`upload size is required`)
+	}
+
+	seeker, canRestart := r.(io.Seeker)
+	begin := int64(0)
+	if canRestart {
+		var err error
+		if begin, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			canRestart = false
+		}
+	}
+
+	br := bufio.NewReaderSize(r, uploadChunkSize)
+
+	// Only the first 261 bytes are used to sniff the content type.
+	head, _ := br.Peek(261)
+
+	var mediatype string
+	if filetype.IsImage(head) {
+		mediatype = `pic`
+	} else if filetype.IsVideo(head) {
+		mediatype = `video`
+	} else {
+		mediatype = `doc`
+	}
+
+	if len(opt.MIME) == 0 {
+		kind, _ := filetype.Match(head)
+		opt.MIME = kind.MIME.Value
+	}
+	if opt.ModTime.IsZero() {
+		opt.ModTime = time.Now()
+	}
+
+	urlOBJ, err := url.Parse(wechat.BaseURL)
+	if err != nil {
+		return ``, err
+	}
+	host := urlOBJ.Host
+
+	hosts := [2]string{
+		fmt.Sprintf(`https://file.%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json`, host),
+		fmt.Sprintf(`https://file2.%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json`, host),
+	}
+
+	// 并发上传时每个文件使用不同的 id
+	fileID := `WU_FILE_` + str(atomic.AddInt64(&mediaIndex, 1)-1)
+
+	for hostIdx := 0; ; hostIdx++ {
+
+		// 每次从头上传都使用新的 ClientMediaId
+		media, err := json.Marshal(&map[string]interface{}{
+			`BaseRequest`:   wechat.BaseRequest,
+			`ClientMediaId`: now(),
+			`TotalLen`:      str(opt.Size),
+			`StartPos`:      0,
+			`DataLen`:       str(opt.Size),
+			`MediaType`:     4,
+			`UploadType`:    2,
+			`ToUserName`:    opt.To,
+			`FromUserName`:  wechat.MySelf.UserName,
+			`FileMd5`:       opt.MD5,
+		})
+		if err != nil {
+			return ``, err
+		}
+
+		fields := map[string]string{
+			`id`:                 fileID,
+			`name`:               opt.Name,
+			`type`:               opt.MIME,
+			`lastModifiedDate`:   opt.ModTime.UTC().String(),
+			`size`:               str(opt.Size),
+			`mediatype`:          mediatype,
+			`uploadmediarequest`: string(media),
+			`pass_ticket`:        wechat.BaseRequest.PassTicket,
+			`webwx_data_ticket`:  wechat.CookieDataTicket(),
+		}
+
+		mediaID, hostFailed, err := wechat.uploadChunks(hosts[hostIdx], br, fields, opt)
+		if err == nil {
+			return mediaID, nil
+		}
+		if !hostFailed || !canRestart || hostIdx+1 >= len(hosts) {
+			return ``, err
+		}
+
+		if _, err = seeker.Seek(begin, io.SeekStart); err != nil {
+			return ``, err
+		}
+		br.Reset(r)
+		wechat.log.Warnf(`分片上传失败，切换上传主机从头上传: %s`, hosts[hostIdx+1])
+	}
+}
+
+// uploadChunks 在一个上传主机上依次上传所有分片，hostFailed 为 true 时可以换一个主机重新上传
+func (wechat *WeChat) uploadChunks(apiURL string, br *bufio.Reader, fields map[string]string, opt UploadOptions) (mediaID string, hostFailed bool, err error) {
+
+	chunks := (opt.Size + uploadChunkSize - 1) / uploadChunkSize
+
+	buf := make([]byte, uploadChunkSize)
+	sent := int64(0)
+
+	for chunk := int64(0); chunk < chunks; chunk++ {
+
+		want := opt.Size - sent
+		if want > uploadChunkSize {
+			want = uploadChunkSize
+		}
+
+		n, err := io.ReadFull(br, buf[:want])
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return ``, false, fmt.Errorf(`upload size mismatch: read %d bytes, expected %d`, sent+int64(n), opt.Size)
+		}
+		if err != nil {
+			return ``, false, err
+		}
+
+		if chunk == chunks-1 {
+			if _, err = br.Peek(1); err == nil {
+				return ``, false, fmt.Errorf(`upload size mismatch: reader has more than %d bytes`, opt.Size)
+			} else if err != io.EOF {
+				return ``, false, err
+			}
+		}
+
+		for attempt := 1; ; attempt++ {
+			mediaID, err = wechat.uploadChunk(apiURL, fields, buf[:n], chunk, chunks)
+			if err == nil {
+				break
+			}
+			// 会话失效之类的错误换主机重试也没有用
+			var apiErr *APIError
+			if errors.As(err, &apiErr) && !apiErr.Retryable() {
+				return ``, false, err
+			}
+			if attempt >= uploadChunkRetry {
+				return ``, true, err
+			}
+			wechat.log.Warnf(`第 %d/%d 个分片上传失败，准备重试: %v`, chunk+1, chunks, err)
+		}
+
+		sent += int64(n)
+		if opt.Progress != nil {
+			opt.Progress(sent, opt.Size)
+		}
+	}
+
+	return mediaID, false, nil
+}
+
+func (wechat *WeChat) uploadChunk(apiURL string, fields map[string]string, data []byte, chunk, chunks int64) (string, error) {
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	if chunks > 1 {
+		writer.WriteField(`chunks`, str(chunks))
+		writer.WriteField(`chunk`, str(chunk))
+	}
+
+	fw, err := writer.CreateFormFile(`filename`, fields[`name`])
+	if err != nil {
+		return ``, err
+	}
+	if _, err = fw.Write(data); err != nil {
+		return ``, err
+	}
+	if err = writer.Close(); err != nil {
+		return ``, err
+	}
+
+	req, err := http.NewRequest(`POST`, apiURL, body)
+	if err != nil {
+		return ``, err
+	}
+	req.Header.Set(`Content-Type`, writer.FormDataContentType())
+
+	resp := new(uploadMediaResponse)
+	if err = wechat.ExcuteRequest(req, resp); err != nil {
+		return ``, err
+	}
+
+	return resp.MediaID, nil
+}
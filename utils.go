@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -17,14 +16,14 @@ func search(source, prefix, suffix string) (string, error) {
 
 	index := strings.Index(source, prefix)
 	if index == -1 {
-		err := fmt.Errorf("can't find [%s] in [%s]", prefix, source)
+		err := fmt.Errorf("can't find [%s] in [%s]", prefix, abbreviate(source))
 		return ``, err
 	}
 	index += len(prefix)
 
 	end := strings.Index(source[index:], suffix)
 	if end == -1 {
-		err := fmt.Errorf("can't find [%s] in [%s]", suffix, source)
+		err := fmt.Errorf("can't find [%s] in [%s]", suffix, abbreviate(source))
 		return ``, err
 	}
 
@@ -33,35 +32,25 @@ func search(source, prefix, suffix string) (string, error) {
 	return result, nil
 }
 
-// ReplaceEmoji replace <span class="emoji emoji[a-f0-9]{5}"></span> to 🍎
-func replaceEmoji(oriStr string) string {
-
-	newStr := oriStr
-
-	if strings.Contains(oriStr, `<span class="emoji`) {
-		reg, _ := regexp.Compile(`<span class="emoji emoji[a-f0-9]{5}"></span>`)
-		newStr = reg.ReplaceAllStringFunc(oriStr, func(arg2 string) string {
-			num := `'\U000` + arg2[len(arg2)-14:len(arg2)-9] + `'`
-			emoji, err := strconv.Unquote(num)
-			if err == nil {
-				return emoji
-			}
-			return num
-		})
+// Abbreviate cut long api result, keep error message readable.
+func abbreviate(s string) string {
+	const max = 128
+	if r := []rune(s); len(r) > max {
+		return string(r[:max]) + `...`
 	}
+	return s
+}
 
-	return newStr
+// saveFile 同 createFile，失败时记录日志
+func (wechat *WeChat) saveFile(name string, data []byte, isAppend bool) {
+	if err := createFile(name, data, isAppend); err != nil {
+		wechat.log.Errorf(`写入文件 [%s] 失败: %v`, name, err)
+	}
 }
 
 // CreateFile save data to filesystem.
 func createFile(name string, data []byte, isAppend bool) (err error) {
 
-	defer func() {
-		if err != nil {
-			log.Error(err.Error())
-		}
-	}()
-
 	oflag := os.O_CREATE | os.O_WRONLY
 	if isAppend {
 		oflag |= os.O_APPEND
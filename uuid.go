@@ -6,6 +6,7 @@ import (
 
 // implements UUIDProcessor
 type defaultUUIDProcessor struct {
+	processorLogger
 	path string
 }
 
@@ -23,7 +24,7 @@ func (dp *defaultUUIDProcessor) ProcessUUID(uuid, filepath string) error {
 		dp.path = path
 		open.Start(path)
 	}()
-	log.Info(`请使用微信扫一扫扫描二维码...`)
+	dp.logger().Info(`请使用微信扫一扫扫描二维码...`)
 
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,14 +16,11 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/num5/logger"
 )
 
-var log *logger.Log
-
 const httpOK = `200`
 
 // BaseRequest is a base for all wx api request.
@@ -56,7 +54,10 @@ func (response *Response) IsSuccess() bool {
 
 // response's error msg.
 func (response *Response) Error() error {
-	return fmt.Errorf("error message:[%s]", response.BaseResponse.ErrMsg)
+	return &APIError{
+		Ret:    response.BaseResponse.Ret,
+		ErrMsg: response.BaseResponse.ErrMsg,
+	}
 }
 
 // BaseResponse for all api resp.
@@ -68,10 +69,27 @@ type BaseResponse struct {
 // Configure ...
 type Configure struct {
 	Processor         UUIDProcessor
+	Logger            Logger           // 日志输出，默认输出到 os.Stderr
+	QRRefresh         int              // 二维码过期以后自动刷新的次数
+	PushLogin         bool             // 会话失效时先推送到手机确认登录，失败再扫码
+	Reconnect         *ReconnectPolicy // 重新登录的策略，默认为 DefaultReconnectPolicy()
+	Heartbeat         time.Duration    // 定时向文件传输助手发送心跳消息，0 为不发送
+	StaleThreshold    time.Duration    // 超过该时间没有同步成功时产生 /sys/stale 事件
 	Debug             bool
-	Storage         string
+	Storage           string
 	FuzzyDiff         bool
 	UniqueGroupMember bool
+	CommandPrefix     string                            // 插件命令前缀
+	Plugins           map[string]map[string]interface{} // 插件配置, key 为插件名称
+	RulesFile         string                            // 自动回复规则文件 .json/.yml/.yaml
+	AutoDownloadMedia bool                              // 自动下载收到的所有附件
+	MediaSink         MediaSink                         // 附件保存位置，默认为 Storage 下按类型分目录
+	Transcriber       Transcriber                       // 语音识别，为空时不识别
+	SyncRetry         int                               // 同步遇到网络错误时最多连续重试的次数
+	SyncBackoff       time.Duration                     // 同步重试的初始等待时间，每次失败翻倍，最长 1 分钟
+	SyncProbeTimeout  time.Duration                     // 测试同步主机的超时时间
+	SyncSlowThreshold time.Duration                     // synccheck 连续 3 次超过该时间时重新挑选主机
+	EncodeEmoji       bool                              // 发送文本时把 Unicode emoji 转换成微信自带表情，默认不转换
 	version           string
 }
 
@@ -79,10 +97,19 @@ type Configure struct {
 func DefaultConfigure() *Configure {
 	return &Configure{
 		Processor:         new(defaultUUIDProcessor),
-		Debug:             true,
+		QRRefresh:         5,
+		PushLogin:         true,
+		Reconnect:         DefaultReconnectPolicy(),
+		StaleThreshold:    5 * time.Minute,
+		Debug:             false,
 		FuzzyDiff:         true,
 		UniqueGroupMember: true,
-		Storage:         `.storage`,
+		CommandPrefix:     `/`,
+		SyncRetry:         5,
+		SyncBackoff:       2 * time.Second,
+		SyncProbeTimeout:  5 * time.Second,
+		SyncSlowThreshold: 40 * time.Second,
+		Storage:           `.storage`,
 		version:           `1.0.1-rc1`,
 	}
 }
@@ -111,13 +138,21 @@ type WeChat struct {
 	MySelf      Contact
 	IsLogin     bool
 
-	conf       *Configure
-	evtStream  *evtStream
-	cache      *cache
-	syncKey    map[string]interface{}
-	syncHost   string
-	retryTimes time.Duration
-	loginState chan int // -1 登录失败 1登录成功
+	conf        *Configure
+	evtStream   *evtStream
+	cache       *cache
+	plugins     *pluginManager
+	rules       *rulesEngine
+	bridges     *bridgeManager
+	media       *mediaStore
+	health      *healthMonitor
+	metrics     *metrics
+	log         *botLogger
+	syncKey     *SyncKey
+	syncHost    string
+	lastMsg     msgMark    // 最后一条消息的时间和 MsgId
+	backfill    *syncPoint // 不为空时开始同步前先补收断线期间的消息
+	backfillEvt chan Event // 补收的消息以及 start、end 事件，按顺序进入 serverEvt
 }
 
 // NewWeChat is desined for Create a new Wechat instance.
@@ -143,15 +178,28 @@ func newWeChat(conf *Configure) (*WeChat, error) {
 	baseReq.Ret = 1
 	baseReq.DeviceID = `e999471493880231`
 
+	m := newMetrics()
+	l := newBotLogger(conf.Logger, conf.Debug)
+
+	if ls, ok := conf.Processor.(loggerSetter); ok {
+		ls.setLogger(l)
+	}
+
 	wechat := &WeChat{
 		Client:      client,
 		BaseRequest: baseReq,
-		evtStream:   newEvtStream(),
+		evtStream:   newEvtStream(m, l),
 		IsLogin:     false,
-		retryTimes:  time.Duration(0),
-		loginState:  make(chan int),
 		conf:        conf,
 		cache:       newCache(conf.contactCachePath()),
+		plugins:     newPluginManager(),
+		rules:       new(rulesEngine),
+		bridges:     newBridgeManager(),
+		media:       newMediaStore(conf.Storage, l),
+		health:      new(healthMonitor),
+		backfillEvt: make(chan Event, 100),
+		metrics:     m,
+		log:         l,
 	}
 
 	return wechat, nil
@@ -196,26 +244,16 @@ func AwakenNewBot(conf *Configure) (*WeChat, error) {
 		return nil, err
 	}
 
-	wechat.evtStream.init()
-	go func() {
-		for {
-			ls := <-wechat.loginState
-			event := Event{
-				Path: `/login`,
-				From: `Wechat`,
-				To:   `End`,
-				Data: ls,
-				Time: time.Now().Unix(),
-			}
-			wechat.evtStream.serverEvt <- event
+	if len(conf.RulesFile) > 0 {
+		if err = wechat.LoadRules(conf.RulesFile); err != nil {
+			return nil, err
 		}
-	}()
+	}
 
+	wechat.evtStream.init()
+	go wechat.backfillQueue()
 	wechat.keepAlive()
-
-	if conf.Debug {
-		log.SetLevel("DEBUG")
-	}
+	go wechat.monitorHealth()
 
 	return wechat, nil
 }
@@ -225,13 +263,23 @@ func (wechat *WeChat) ExcuteRequest(req *http.Request, call Caller) error {
 
 	filename := wechat.conf.httpDebugPath(req.URL)
 
+	// 调试文件同样隐藏登录凭证，cookie 只保留名称
 	if wechat.conf.Debug {
 		reqData, _ := httputil.DumpRequestOut(req, false)
-		createFile(filename+`_req.json`, reqData, false)
-		c, _ := json.Marshal(wechat.Client.Jar.Cookies(req.URL))
-		createFile(filename+`_req.json`, c, true)
+		wechat.saveFile(filename+`_req.json`, []byte(redact(string(reqData))), false)
+		var cookies []string
+		for _, ck := range wechat.Client.Jar.Cookies(req.URL) {
+			cookies = append(cookies, ck.Name+`=***`)
+		}
+		c, _ := json.Marshal(cookies)
+		wechat.saveFile(filename+`_req.json`, c, true)
 	}
 
+	start, ret := time.Now(), `error`
+	defer func() {
+		wechat.metrics.observeRequest(endpoint(req.URL), ret, time.Since(start))
+	}()
+
 	resp, err := wechat.Client.Do(req)
 
 	if err != nil {
@@ -248,7 +296,7 @@ func (wechat *WeChat) ExcuteRequest(req *http.Request, call Caller) error {
 			return e
 		}
 
-		createFile(filename+`_resp.json`, data, true)
+		wechat.saveFile(filename+`_resp.json`, []byte(redact(string(data))), true)
 		reader = bytes.NewReader(data)
 	}
 
@@ -257,9 +305,19 @@ func (wechat *WeChat) ExcuteRequest(req *http.Request, call Caller) error {
 	}
 
 	if !call.IsSuccess() {
-		return call.Error()
+		err = call.Error()
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			ret = strconv.Itoa(apiErr.Ret)
+			if len(apiErr.Endpoint) == 0 {
+				apiErr.Endpoint = endpoint(req.URL)
+			}
+		}
+		return err
 	}
 
+	ret = `0`
+
 	wechat.refreshBaseInfo()
 	wechat.refreshCookieCache(resp.Cookies())
 
@@ -292,20 +350,3 @@ func (wechat *WeChat) PassTicketKV() string {
 func (wechat *WeChat) SkeyKV() string {
 	return fmt.Sprintf(`skey=%s`, wechat.BaseRequest.Skey)
 }
-
-func init() {
-
-	// 初始化
-	log = logger.NewLog(1000)
-
-	// 设置log级别
-	log.SetLevel("Debug")
-
-	// 设置输出引擎
-	log.SetEngine("file", `{"level":4, "spilt":"size", "filename":".storage/logs/wechat.log", "maxsize":10}`)
-
-	//log.DelEngine("console")
-
-	// 设置是否输出行号
-	log.SetFuncCall(true)
-}